@@ -26,6 +26,9 @@ import (
 	"errors"
 	"net"
 	"strings"
+	"time"
+
+	v3orcapb "github.com/cncf/xds/go/xds/data/orca/v3"
 
 	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
@@ -125,8 +128,57 @@ type NewSubConnOptions struct {
 	// arbitrary data to the credential handshaker.
 	CredsBundle credentials.Bundle
 	// HealthCheckEnabled indicates whether health check service should be
-	// enabled on this SubConn
+	// enabled on this SubConn, using the gRPC-native health-checking
+	// protocol.
+	//
+	// Deprecated: set HealthChecker instead, which also covers this case via
+	// RegisterHealthChecker's default "grpc" checker. Setting both is an
+	// error.
 	HealthCheckEnabled bool
+	// HealthChecker selects the health-checking strategy to run against this
+	// SubConn, e.g. the built-in gRPC health protocol, an HTTP /healthz
+	// probe, a TCP probe, or an xDS/ORCA-derived health signal. If nil, the
+	// ClientConn's BuildOptions.DefaultHealthChecker is used (which itself
+	// defaults to the gRPC-native health protocol). A ClientConn backs this
+	// by holding a healthcheck.Manager and calling Start/Stop for each
+	// SubConn as it is created/removed.
+	HealthChecker HealthChecker
+}
+
+// HealthChecker implements a health-checking strategy that can be run
+// against a SubConn, in place of the built-in gRPC health-checking protocol.
+// A HealthChecker is selected per SubConn via NewSubConnOptions.HealthChecker
+// or BuildOptions.DefaultHealthChecker, and registered globally with
+// RegisterHealthChecker.
+type HealthChecker interface {
+	// Watch monitors serviceName's health, invoking report every time the
+	// observed connectivity.State changes, until ctx is done. A HealthChecker
+	// that determines the backend is unhealthy reports
+	// connectivity.TransientFailure with a descriptive error; reverting to
+	// connectivity.Ready once it recovers.
+	Watch(ctx context.Context, serviceName string, report func(connectivity.State, error)) error
+	// Name returns the name this HealthChecker is registered under.
+	Name() string
+}
+
+// healthCheckers is a map from name to registered HealthChecker.
+var healthCheckers = make(map[string]HealthChecker)
+
+// RegisterHealthChecker registers hc under strings.ToLower(hc.Name()), to be
+// selected via NewSubConnOptions.HealthChecker/BuildOptions.DefaultHealthChecker
+// by name. It mirrors Register.
+//
+// NOTE: this function must only be called during initialization time (i.e.
+// in an init() function), and is not thread-safe. If multiple HealthCheckers
+// are registered with the same name, the one registered last takes effect.
+func RegisterHealthChecker(hc HealthChecker) {
+	healthCheckers[strings.ToLower(hc.Name())] = hc
+}
+
+// GetHealthChecker returns the HealthChecker registered with the given name,
+// performing a case-insensitive compare, or nil if none is registered.
+func GetHealthChecker(name string) HealthChecker {
+	return healthCheckers[strings.ToLower(name)]
 }
 
 // State contains the balancer's state relevant to the gRPC ClientConn.
@@ -154,6 +206,35 @@ type ClientConn interface {
 	// Target 返回此ClientConn的拨号目标。
 	// 已废弃: 使用 BuildOptions中的Target字段代替
 	Target() string
+	// RegisterOOBListener registers an OOBListener to receive ORCA load
+	// reports from sc's out-of-band metrics stream, opening the stream if
+	// this is the first listener registered for sc. The returned cancel
+	// function unregisters the listener, closing the stream once the last
+	// listener for sc is gone. A ClientConn backs this by holding an
+	// orca.Producer and forwarding every call to it.
+	//
+	// 将l注册为sc的带外(out-of-band)负载报告监听者。 gRPC为每个拥有至少一个
+	// 监听者的SubConn维护一个到ORCA OpenRcaService.StreamCoreMetrics的长连接流，
+	// 并将收到的报告分发给所有注册的监听者。
+	RegisterOOBListener(SubConn, OOBListener, OOBListenerOptions) (cancel func())
+}
+
+// OOBListener is notified of load reports received out-of-band from a
+// SubConn's dedicated ORCA streaming call, as registered via
+// ClientConn.RegisterOOBListener.
+type OOBListener interface {
+	// OnLoadReport is called with each load report received on sc's
+	// out-of-band metrics stream.
+	OnLoadReport(sc SubConn, report *v3orcapb.OrcaLoadReport)
+}
+
+// OOBListenerOptions contains options used to negotiate a SubConn's
+// out-of-band ORCA metrics stream.
+type OOBListenerOptions struct {
+	// ReportInterval is the requested interval between load reports,
+	// communicated to the server via the "orca_load_report_interval"
+	// metadata header on the streaming call.
+	ReportInterval time.Duration
 }
 
 // BuildOptions contains additional information for Build.
@@ -178,6 +259,10 @@ type BuildOptions struct {
 	// passed to the resolver.
 	// See the documentation for the resolver.Target type for details about what it contains.
 	Target resolver.Target
+	// DefaultHealthChecker is the HealthChecker used for a SubConn created
+	// with a nil NewSubConnOptions.HealthChecker. If nil, the ClientConn
+	// falls back to the gRPC-native health-checking protocol.
+	DefaultHealthChecker HealthChecker
 }
 
 // Builder 创建一个balancer
@@ -203,6 +288,28 @@ type PickInfo struct {
 	// Ctx is the RPC's context, and may contain relevant RPC-level information
 	// like the outgoing header metadata.
 	Ctx context.Context
+	// HashKey是从Ctx中提取的一致性哈希键(通过WithHashKey设置)，由consistent-hash
+	// 类picker(如ring_hash)使用以将请求粘附到特定的后端。 如果为空则不启用一致性哈希，
+	// picker应回退到其默认的选择策略。
+	HashKey string
+}
+
+// hashKeyContextKey is the context key under which WithHashKey stores the
+// request's consistent-hash key.
+type hashKeyContextKey struct{}
+
+// WithHashKey returns a copy of ctx carrying key as the consistent-hash key
+// for this RPC. gRPC copies it into PickInfo.HashKey so that a picker such as
+// ring_hash can use it to select a SubConn.
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyContextKey{}, key)
+}
+
+// HashKeyFromContext returns the consistent-hash key previously attached to
+// ctx via WithHashKey, and whether one was present.
+func HashKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(hashKeyContextKey{}).(string)
+	return key, ok
 }
 
 // DoneInfo 包含done的附加信息
@@ -220,6 +327,11 @@ type DoneInfo struct {
 	//
 	// The only supported type now is *orca_v1.LoadReport.
 	ServerLoad interface{}
+	// OOBLoad is the most recent load report received out-of-band from the
+	// picked SubConn's ORCA streaming call, if any listener is registered
+	// for it via ClientConn.RegisterOOBListener. Unlike ServerLoad, it is
+	// not tied to this particular RPC's trailers.
+	OOBLoad *v3orcapb.OrcaLoadReport
 }
 
 var (
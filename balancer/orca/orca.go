@@ -0,0 +1,254 @@
+/*
+ *
+ * Copyright 2021 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package orca provides helpers for balancers that want out-of-band backend
+// load reports delivered through the ORCA service
+// (OpenRcaService.StreamCoreMetrics), as opposed to the per-call
+// DoneInfo.ServerLoad delivered via trailers.
+//
+// gRPC core opens one OpenRcaService.StreamCoreMetrics stream per SubConn
+// that has at least one listener registered via
+// balancer.ClientConn.RegisterOOBListener, requesting the
+// "orca_load_report_interval" the listener asked for, and dispatches each
+// report it receives to every registered listener for that SubConn,
+// retrying the stream with backoff if it fails.
+//
+// Producer implements that behavior. A concrete ClientConn backs its
+// RegisterOOBListener method by holding one Producer and forwarding every
+// call to it; Producer itself stays decoupled from the transport that owns
+// each SubConn's connection by taking a NewStreamFunc, the same indirection
+// internal/healthcheck uses for the same reason.
+package orca
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	v3orcapb "github.com/cncf/xds/go/xds/data/orca/v3"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/metadata"
+)
+
+// StreamMethod is the full method name of the ORCA out-of-band metrics
+// streaming call.
+const StreamMethod = "/xds.service.orca.v3.OpenRcaService/StreamCoreMetrics"
+
+// loadReportIntervalHeader is the metadata key a stream's initiating context
+// carries the requested ReportInterval in, per the ORCA protocol.
+const loadReportIntervalHeader = "orca_load_report_interval"
+
+const maxBackoff = 120 * time.Second
+
+// ListenerFunc adapts a function to a balancer.OOBListener, so a balancer
+// doesn't need to declare a named type just to implement OnLoadReport.
+type ListenerFunc func(balancer.SubConn, *v3orcapb.OrcaLoadReport)
+
+// OnLoadReport calls f.
+func (f ListenerFunc) OnLoadReport(sc balancer.SubConn, report *v3orcapb.OrcaLoadReport) {
+	f(sc, report)
+}
+
+// orcaStream is the subset of grpc.ClientStream a running OOB stream needs.
+type orcaStream interface {
+	RecvMsg(m interface{}) error
+	CloseSend() error
+}
+
+// NewStreamFunc opens a stream for the given fully-qualified method on a
+// SubConn's connection, with ctx carrying whatever outgoing metadata the
+// caller attached. It is supplied by whatever owns that connection (gRPC
+// core's SubConn wrapper, in the real client).
+type NewStreamFunc func(ctx context.Context, method string) (interface{}, error)
+
+// Producer owns the out-of-band ORCA metrics stream for every SubConn that
+// has at least one registered listener: one stream per SubConn, requesting
+// the shortest ReportInterval asked for by any of that SubConn's listeners,
+// retried with backoff, fanning each report out to every listener
+// registered for that SubConn. It implements the behavior documented on
+// balancer.ClientConn.RegisterOOBListener.
+type Producer struct {
+	mu      sync.Mutex
+	streams map[balancer.SubConn]*oobStream
+}
+
+// NewProducer creates a Producer with no active streams.
+func NewProducer() *Producer {
+	return &Producer{streams: make(map[balancer.SubConn]*oobStream)}
+}
+
+// Register adds l to sc's listener set and (re)opens sc's out-of-band stream
+// via newStream, so that the stream requests the shortest interval now asked
+// for. The returned cancel function removes this registration of l, closing
+// the stream once it was the last listener for sc and otherwise reopening
+// it. It implements balancer.ClientConn.RegisterOOBListener for a ClientConn
+// that holds a Producer.
+//
+// p.mu is held across the add/remove on s as well as the map lookup/delete,
+// not just the map access, so that a cancel racing a concurrent Register for
+// the same sc can't decide to delete s from the map after Register already
+// handed that same s out to a new listener: whichever of the two runs first
+// under p.mu determines whether s ends the call empty (and is removed) or
+// not (and stays, serving the listener the other call added).
+func (p *Producer) Register(sc balancer.SubConn, newStream NewStreamFunc, l balancer.OOBListener, opts balancer.OOBListenerOptions) (cancel func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.streams[sc]
+	if !ok {
+		s = &oobStream{sc: sc, listeners: make(map[balancer.OOBListener]time.Duration)}
+		p.streams[sc] = s
+	}
+	// Key the listener set by a pointer, since l itself may be of an
+	// incomparable type such as ListenerFunc.
+	ref := &listenerRef{l}
+	s.addListener(ref, opts.ReportInterval, newStream)
+
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if s.removeListener(ref) {
+			delete(p.streams, sc)
+		}
+	}
+}
+
+// listenerRef gives each registration a distinct, comparable map key.
+type listenerRef struct{ balancer.OOBListener }
+
+// oobStream is the single out-of-band stream backing one SubConn, shared by
+// every listener registered for it.
+type oobStream struct {
+	sc balancer.SubConn
+
+	mu        sync.Mutex
+	listeners map[balancer.OOBListener]time.Duration // requested ReportInterval per listener
+	newStream NewStreamFunc
+	cancel    context.CancelFunc // cancels the currently running stream, if any
+}
+
+func (s *oobStream) addListener(l balancer.OOBListener, interval time.Duration, newStream NewStreamFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.newStream == nil {
+		s.newStream = newStream
+	}
+	s.listeners[l] = interval
+	s.restartLocked()
+}
+
+// removeListener reports whether s now has no listeners left.
+func (s *oobStream) removeListener(l balancer.OOBListener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+	if len(s.listeners) == 0 {
+		if s.cancel != nil {
+			s.cancel()
+			s.cancel = nil
+		}
+		return true
+	}
+	s.restartLocked()
+	return false
+}
+
+// restartLocked cancels any running stream and starts a new one requesting
+// the shortest interval currently asked for, since the interval can only be
+// renegotiated by reopening the stream.
+func (s *oobStream) restartLocked() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.run(ctx, s.minIntervalLocked())
+}
+
+func (s *oobStream) minIntervalLocked() time.Duration {
+	var min time.Duration
+	first := true
+	for _, iv := range s.listeners {
+		if first || iv < min {
+			min, first = iv, false
+		}
+	}
+	return min
+}
+
+// run keeps a stream open for interval, retrying with exponential backoff
+// (capped at maxBackoff) until ctx is canceled.
+func (s *oobStream) run(ctx context.Context, interval time.Duration) {
+	backoff := time.Second
+	for {
+		if err := s.runOnce(ctx, interval); err == nil {
+			backoff = time.Second
+		} else {
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (s *oobStream) runOnce(ctx context.Context, interval time.Duration) error {
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs(loadReportIntervalHeader, interval.String()))
+
+	raw, err := s.newStream(ctx, StreamMethod)
+	if err != nil {
+		return fmt.Errorf("orca: error creating stream: %v", err)
+	}
+	stream, ok := raw.(orcaStream)
+	if !ok {
+		return fmt.Errorf("orca: newStream returned unexpected type %T", raw)
+	}
+	defer stream.CloseSend()
+
+	for {
+		report := new(v3orcapb.OrcaLoadReport)
+		if err := stream.RecvMsg(report); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		s.dispatch(report)
+	}
+}
+
+func (s *oobStream) dispatch(report *v3orcapb.OrcaLoadReport) {
+	s.mu.Lock()
+	ls := make([]balancer.OOBListener, 0, len(s.listeners))
+	for l := range s.listeners {
+		ls = append(ls, l)
+	}
+	s.mu.Unlock()
+
+	for _, l := range ls {
+		l.OnLoadReport(s.sc, report)
+	}
+}
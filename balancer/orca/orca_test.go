@@ -0,0 +1,169 @@
+/*
+ *
+ * Copyright 2023 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package orca
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	v3orcapb "github.com/cncf/xds/go/xds/data/orca/v3"
+
+	"google.golang.org/grpc/balancer"
+)
+
+type fakeSubConn struct{ balancer.SubConn }
+
+// fakeStream replays a fixed sequence of reports, then io.EOF.
+type fakeStream struct {
+	reports []*v3orcapb.OrcaLoadReport
+	i       int
+}
+
+func (s *fakeStream) RecvMsg(m interface{}) error {
+	if s.i >= len(s.reports) {
+		return io.EOF
+	}
+	*m.(*v3orcapb.OrcaLoadReport) = *s.reports[s.i]
+	s.i++
+	return nil
+}
+
+func (s *fakeStream) CloseSend() error { return nil }
+
+func TestProducerDispatchesToListener(t *testing.T) {
+	sc := fakeSubConn{}
+	want := &v3orcapb.OrcaLoadReport{CpuUtilization: 0.5}
+
+	var mu sync.Mutex
+	var got []*v3orcapb.OrcaLoadReport
+	l := ListenerFunc(func(gotSC balancer.SubConn, report *v3orcapb.OrcaLoadReport) {
+		if gotSC != balancer.SubConn(sc) {
+			t.Errorf("OnLoadReport called with SubConn %v, want %v", gotSC, sc)
+		}
+		mu.Lock()
+		got = append(got, report)
+		mu.Unlock()
+	})
+
+	newStream := func(ctx context.Context, method string) (interface{}, error) {
+		if method != StreamMethod {
+			t.Errorf("newStream called with method %q, want %q", method, StreamMethod)
+		}
+		return &fakeStream{reports: []*v3orcapb.OrcaLoadReport{want}}, nil
+	}
+
+	p := NewProducer()
+	cancel := p.Register(sc, newStream, l, balancer.OOBListenerOptions{ReportInterval: time.Millisecond})
+	defer cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(got)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) == 0 {
+		t.Fatal("listener never received a load report")
+	}
+	if got[0].CpuUtilization != want.CpuUtilization {
+		t.Errorf("got report %+v, want %+v", got[0], want)
+	}
+}
+
+func TestProducerRemovesStreamOnLastCancel(t *testing.T) {
+	sc := fakeSubConn{}
+	newStream := func(ctx context.Context, method string) (interface{}, error) {
+		return &fakeStream{}, nil
+	}
+
+	p := NewProducer()
+	cancel := p.Register(sc, newStream, ListenerFunc(func(balancer.SubConn, *v3orcapb.OrcaLoadReport) {}), balancer.OOBListenerOptions{})
+
+	p.mu.Lock()
+	_, ok := p.streams[sc]
+	p.mu.Unlock()
+	if !ok {
+		t.Fatal("Register did not create a stream entry")
+	}
+
+	cancel()
+
+	p.mu.Lock()
+	_, ok = p.streams[sc]
+	p.mu.Unlock()
+	if ok {
+		t.Error("stream entry still present after the last listener canceled")
+	}
+}
+
+// TestProducerRegisterRaceWithCancel repeatedly cancels a SubConn's only
+// listener concurrently with registering a new one for the same SubConn, and
+// requires that no race leaves the map entry holding anything but the new
+// listener: if the cancel runs first it deletes the old entry and the
+// Register creates a fresh one; if the Register runs first it joins the
+// existing entry and the cancel then removes only the old registration,
+// leaving the entry in place with one listener. Before p.mu was
+// held across the whole add/remove-then-maybe-delete sequence, the losing
+// order of these two calls could delete a *oobStream from the map that a
+// concurrent Register had just handed a listener to, leaving that listener's
+// stream orphaned and a subsequent Register creating a redundant second one.
+func TestProducerRegisterRaceWithCancel(t *testing.T) {
+	sc := fakeSubConn{}
+	newStream := func(ctx context.Context, method string) (interface{}, error) {
+		return &fakeStream{}, nil
+	}
+	noop := ListenerFunc(func(balancer.SubConn, *v3orcapb.OrcaLoadReport) {})
+
+	p := NewProducer()
+	cancel := p.Register(sc, newStream, noop, balancer.OOBListenerOptions{})
+
+	for i := 0; i < 200; i++ {
+		var wg sync.WaitGroup
+		var nextCancel func()
+		wg.Add(2)
+		go func() { defer wg.Done(); cancel() }()
+		go func() { defer wg.Done(); nextCancel = p.Register(sc, newStream, noop, balancer.OOBListenerOptions{}) }()
+		wg.Wait()
+		cancel = nextCancel
+
+		p.mu.Lock()
+		s, ok := p.streams[sc]
+		if ok {
+			s.mu.Lock()
+			n := len(s.listeners)
+			s.mu.Unlock()
+			if n != 1 {
+				p.mu.Unlock()
+				t.Fatalf("iteration %d: stream entry present with %d listeners, want 1", i, n)
+			}
+		}
+		p.mu.Unlock()
+	}
+	cancel()
+}
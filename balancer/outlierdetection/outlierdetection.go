@@ -0,0 +1,502 @@
+/*
+ *
+ * Copyright 2021 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package outlierdetection implements a delegating balancer that wraps any
+// other registered balancer and ejects addresses that misbehave, based on
+// success-rate and failure-percentage statistics gathered from
+// PickResult.Done callbacks, per the xDS OutlierDetection configuration
+// (https://www.envoyproxy.io/docs/envoy/latest/intro/arch_overview/upstream/outlier).
+//
+// 该balancer本身不做选择，而是包装一个child balancer: 拦截child与真正
+// ClientConn之间的NewSubConn/RemoveSubConn调用记录地址，在Done回调里统计
+// 每个地址的成功/失败次数，并周期性运行success-rate与failure-percentage两种
+// 驱逐算法。 child的picker若选中被驱逐的地址，包装后的picker返回
+// ErrNoSubConnAvailable；child本身不会收到该地址的任何状态变化，也不会因此
+// 重新选择。 驱逐时长为baseEjectionTime*ejectionCount，上限为maxEjectionTime。
+package outlierdetection
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Name is the name of the outlier_detection_experimental balancer.
+const Name = "outlier_detection_experimental"
+
+func init() {
+	balancer.Register(builder{})
+}
+
+// SuccessRateEjection is the xDS SuccessRateEjection message.
+type SuccessRateEjection struct {
+	StdevFactor uint32 `json:"stdevFactor,omitempty"`
+	// EnforcementPercentage is the percent chance, out of 100, that a host
+	// found to be an outlier by this algorithm is actually ejected; see
+	// enforcementPercentage for its xDS-specified default.
+	EnforcementPercentage uint32 `json:"enforcementPercentage,omitempty"`
+	MinimumHosts          uint32 `json:"minimumHosts,omitempty"`
+	RequestVolume         uint32 `json:"requestVolume,omitempty"`
+}
+
+// enforcementPercentage defaults EnforcementPercentage to 100 (always
+// enforce) when unset, per the xDS SuccessRateEjection message -- unlike
+// FailurePercentageEjection, whose equivalent field defaults to 0.
+func (sre *SuccessRateEjection) enforcementPercentage() uint32 {
+	if sre.EnforcementPercentage == 0 {
+		return 100
+	}
+	return sre.EnforcementPercentage
+}
+
+// FailurePercentageEjection is the xDS FailurePercentageEjection message.
+type FailurePercentageEjection struct {
+	Threshold uint32 `json:"threshold,omitempty"`
+	// EnforcementPercentage is the percent chance, out of 100, that a host
+	// found to be an outlier by this algorithm is actually ejected. Unlike
+	// SuccessRateEjection's field, this one defaults to 0 (never enforce)
+	// per the xDS message, which the zero value already matches, since
+	// FailurePercentageEjection itself is off unless configured.
+	EnforcementPercentage uint32 `json:"enforcementPercentage,omitempty"`
+	MinimumHosts          uint32 `json:"minimumHosts,omitempty"`
+	RequestVolume         uint32 `json:"requestVolume,omitempty"`
+}
+
+// childPolicy names the single child balancer to delegate Picks to, mirroring
+// the [{name: config}] encoding used by loadBalancingConfig entries.
+type childPolicy struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// config is the balancer config parsed from the loadBalancingConfig JSON for
+// outlier_detection_experimental, matching xDS's OutlierDetection message.
+type config struct {
+	serviceconfig.LoadBalancingConfig
+
+	IntervalMillis            int64                      `json:"intervalMillis,omitempty"`
+	BaseEjectionTimeMillis    int64                      `json:"baseEjectionTimeMillis,omitempty"`
+	MaxEjectionTimeMillis     int64                      `json:"maxEjectionTimeMillis,omitempty"`
+	MaxEjectionPercent        uint32                     `json:"maxEjectionPercent,omitempty"`
+	SuccessRateEjection       *SuccessRateEjection       `json:"successRateEjection,omitempty"`
+	FailurePercentageEjection *FailurePercentageEjection `json:"failurePercentageEjection,omitempty"`
+	ChildPolicy               []childPolicy              `json:"childPolicy,omitempty"`
+}
+
+func (c *config) interval() time.Duration {
+	if c.IntervalMillis <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.IntervalMillis) * time.Millisecond
+}
+
+func (c *config) baseEjectionTime() time.Duration {
+	if c.BaseEjectionTimeMillis <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.BaseEjectionTimeMillis) * time.Millisecond
+}
+
+func (c *config) maxEjectionTime() time.Duration {
+	if c.MaxEjectionTimeMillis <= 0 {
+		return 300 * time.Second
+	}
+	return time.Duration(c.MaxEjectionTimeMillis) * time.Millisecond
+}
+
+func (c *config) maxEjectionPercent() uint32 {
+	if c.MaxEjectionPercent == 0 {
+		return 10
+	}
+	return c.MaxEjectionPercent
+}
+
+type builder struct{}
+
+func (builder) Name() string { return Name }
+
+func (builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	b := &odBalancer{cc: cc, opts: opts, addrs: make(map[resolver.Address]*addrInfo)}
+	b.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	b.done = make(chan struct{})
+	return b
+}
+
+// ParseConfig implements balancer.ConfigParser.
+func (builder) ParseConfig(c json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	var cfg config
+	if err := json.Unmarshal(c, &cfg); err != nil {
+		return nil, fmt.Errorf("outlierdetection: unable to unmarshal LB policy config: %v", err)
+	}
+	if len(cfg.ChildPolicy) == 0 {
+		return nil, fmt.Errorf("outlierdetection: no childPolicy configured")
+	}
+	if balancer.Get(cfg.ChildPolicy[0].Name) == nil {
+		return nil, fmt.Errorf("outlierdetection: childPolicy %q is not registered", cfg.ChildPolicy[0].Name)
+	}
+	return &cfg, nil
+}
+
+// addrInfo is the per-address ejection bookkeeping kept by the wrapper.
+type addrInfo struct {
+	successes uint32
+	failures  uint32
+
+	ejected       bool
+	ejectionTime  time.Time
+	ejectionCount int64
+}
+
+func (a *addrInfo) volume() uint32 { return a.successes + a.failures }
+
+func (a *addrInfo) successRate() float64 {
+	v := a.volume()
+	if v == 0 {
+		return 1
+	}
+	return float64(a.successes) / float64(v)
+}
+
+func (a *addrInfo) failureRate() float64 {
+	v := a.volume()
+	if v == 0 {
+		return 0
+	}
+	return float64(a.failures) / float64(v)
+}
+
+// odBalancer is the outlier-detection wrapper. It owns no SubConns itself;
+// it delegates all of them to a child balancer, interposing on the
+// ClientConn it gives that child so it can count successes/failures per
+// address and reject Picks of ejected addresses.
+type odBalancer struct {
+	cc   balancer.ClientConn
+	opts balancer.BuildOptions
+
+	child      balancer.Balancer
+	childBuild bool
+
+	mu    sync.Mutex
+	addrs map[resolver.Address]*addrInfo
+	cfg   *config
+
+	// rng draws the EnforcementPercentage coin flip for each ejection
+	// candidate in detectOutliers; it's read only from that single
+	// goroutine (b.run's ticker loop), so it needs no mutex of its own
+	// unlike b.addrs/b.cfg, which the picker also reads/writes.
+	rng *rand.Rand
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (b *odBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	cfg, ok := s.BalancerConfig.(*config)
+	if !ok || cfg == nil || len(cfg.ChildPolicy) == 0 {
+		return fmt.Errorf("outlierdetection: invalid balancer config %+v", s.BalancerConfig)
+	}
+	childBuilder := balancer.Get(cfg.ChildPolicy[0].Name)
+	if childBuilder == nil {
+		return fmt.Errorf("outlierdetection: childPolicy %q is not registered", cfg.ChildPolicy[0].Name)
+	}
+
+	b.mu.Lock()
+	b.cfg = cfg
+	for _, a := range s.ResolverState.Addresses {
+		if _, ok := b.addrs[a]; !ok {
+			b.addrs[a] = &addrInfo{}
+		}
+	}
+	b.mu.Unlock()
+
+	if !b.childBuild {
+		b.child = childBuilder.Build(&odClientConn{b: b}, b.opts)
+		b.childBuild = true
+		go b.run()
+	}
+
+	var childCfg serviceconfig.LoadBalancingConfig
+	if parser, ok := childBuilder.(balancer.ConfigParser); ok && len(cfg.ChildPolicy[0].Config) > 0 {
+		c, err := parser.ParseConfig(cfg.ChildPolicy[0].Config)
+		if err != nil {
+			return fmt.Errorf("outlierdetection: error parsing child policy config: %v", err)
+		}
+		childCfg = c
+	}
+
+	return b.child.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState:  s.ResolverState,
+		BalancerConfig: childCfg,
+	})
+}
+
+func (b *odBalancer) ResolverError(err error) {
+	if b.child != nil {
+		b.child.ResolverError(err)
+	}
+}
+
+func (b *odBalancer) UpdateSubConnState(sc balancer.SubConn, s balancer.SubConnState) {
+	if b.child != nil {
+		b.child.UpdateSubConnState(sc, s)
+	}
+}
+
+func (b *odBalancer) Close() {
+	b.closeOnce.Do(func() { close(b.done) })
+	if b.child != nil {
+		b.child.Close()
+	}
+}
+
+// run periodically applies the success-rate and failure-percentage ejection
+// algorithms until the balancer is closed.
+func (b *odBalancer) run() {
+	for {
+		b.mu.Lock()
+		interval := b.cfg.interval()
+		b.mu.Unlock()
+
+		t := time.NewTimer(interval)
+		select {
+		case <-b.done:
+			t.Stop()
+			return
+		case <-t.C:
+			b.detectOutliers()
+		}
+	}
+}
+
+func (b *odBalancer) detectOutliers() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg := b.cfg
+	if cfg == nil {
+		return
+	}
+
+	now := time.Now()
+	maxEjected := (uint32(len(b.addrs)) * cfg.maxEjectionPercent()) / 100
+	var ejectedCount uint32
+	for _, a := range b.addrs {
+		if a.ejected {
+			ejectedCount++
+		}
+	}
+
+	if cfg.SuccessRateEjection != nil {
+		b.applySuccessRateEjection(cfg, now, &ejectedCount, maxEjected)
+	}
+	if cfg.FailurePercentageEjection != nil {
+		b.applyFailurePercentageEjection(cfg, now, &ejectedCount, maxEjected)
+	}
+
+	// Un-eject any address whose ejection period has elapsed.
+	for _, a := range b.addrs {
+		if !a.ejected {
+			continue
+		}
+		ejectionTime := cfg.baseEjectionTime() * time.Duration(a.ejectionCount)
+		if max := cfg.maxEjectionTime(); ejectionTime > max {
+			ejectionTime = max
+		}
+		if now.Sub(a.ejectionTime) >= ejectionTime {
+			a.ejected = false
+		}
+	}
+
+	// A new detection round starts with a clean slate of counters, per the
+	// xDS outlier detection algorithm.
+	for _, a := range b.addrs {
+		a.successes, a.failures = 0, 0
+	}
+}
+
+func (b *odBalancer) applySuccessRateEjection(cfg *config, now time.Time, ejectedCount *uint32, maxEjected uint32) {
+	sre := cfg.SuccessRateEjection
+	var candidates []*addrInfo
+	var sum, sumSq float64
+	for _, a := range b.addrs {
+		if a.volume() < sre.RequestVolume {
+			continue
+		}
+		candidates = append(candidates, a)
+		sum += a.successRate()
+	}
+	if uint32(len(candidates)) < sre.MinimumHosts || len(candidates) == 0 {
+		return
+	}
+	mean := sum / float64(len(candidates))
+	for _, a := range candidates {
+		d := a.successRate() - mean
+		sumSq += d * d
+	}
+	stddev := math.Sqrt(sumSq / float64(len(candidates)))
+	threshold := mean - (float64(sre.StdevFactor)/1000)*stddev
+
+	for _, a := range candidates {
+		if *ejectedCount >= maxEjected {
+			return
+		}
+		if a.ejected || a.successRate() >= threshold {
+			continue
+		}
+		if b.rng.Intn(100) >= int(sre.enforcementPercentage()) {
+			continue
+		}
+		eject(a, now)
+		*ejectedCount++
+	}
+}
+
+func (b *odBalancer) applyFailurePercentageEjection(cfg *config, now time.Time, ejectedCount *uint32, maxEjected uint32) {
+	fpe := cfg.FailurePercentageEjection
+	var n uint32
+	for _, a := range b.addrs {
+		if a.volume() >= fpe.RequestVolume {
+			n++
+		}
+	}
+	if n < fpe.MinimumHosts {
+		return
+	}
+	for _, a := range b.addrs {
+		if *ejectedCount >= maxEjected {
+			return
+		}
+		if a.ejected || a.volume() < fpe.RequestVolume {
+			continue
+		}
+		if a.failureRate()*100 > float64(fpe.Threshold) && b.rng.Intn(100) < int(fpe.EnforcementPercentage) {
+			eject(a, now)
+			*ejectedCount++
+		}
+	}
+}
+
+func eject(a *addrInfo, now time.Time) {
+	a.ejected = true
+	a.ejectionTime = now
+	a.ejectionCount++
+}
+
+// odClientConn sits between the child balancer and the real ClientConn: it
+// records which address backs each SubConn the child creates, and wraps
+// every Picker the child installs so Pick results against ejected addresses
+// are rejected before reaching the transport.
+type odClientConn struct {
+	b *odBalancer
+}
+
+func (occ *odClientConn) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("outlierdetection: NewSubConn called with empty address list")
+	}
+
+	sc, err := occ.b.cc.NewSubConn(addrs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	occ.b.mu.Lock()
+	if _, ok := occ.b.addrs[addrs[0]]; !ok {
+		occ.b.addrs[addrs[0]] = &addrInfo{}
+	}
+	occ.b.mu.Unlock()
+
+	return &odSubConn{SubConn: sc, addr: addrs[0], occ: occ}, nil
+}
+
+func (occ *odClientConn) RemoveSubConn(sc balancer.SubConn) {
+	if wrapped, ok := sc.(*odSubConn); ok {
+		occ.b.cc.RemoveSubConn(wrapped.SubConn)
+		return
+	}
+	occ.b.cc.RemoveSubConn(sc)
+}
+
+func (occ *odClientConn) UpdateState(s balancer.State) {
+	occ.b.cc.UpdateState(balancer.State{
+		ConnectivityState: s.ConnectivityState,
+		Picker:            &odPicker{occ: occ, child: s.Picker},
+	})
+}
+
+func (occ *odClientConn) ResolveNow(o resolver.ResolveNowOptions) { occ.b.cc.ResolveNow(o) }
+func (occ *odClientConn) Target() string                          { return occ.b.cc.Target() }
+func (occ *odClientConn) RegisterOOBListener(sc balancer.SubConn, l balancer.OOBListener, o balancer.OOBListenerOptions) func() {
+	return occ.b.cc.RegisterOOBListener(sc, l, o)
+}
+
+// odSubConn associates a SubConn with the address it was created for, so the
+// picker can find that address's ejection state in O(1) from a PickResult.
+type odSubConn struct {
+	balancer.SubConn
+	addr resolver.Address
+	occ  *odClientConn
+}
+
+type odPicker struct {
+	occ   *odClientConn
+	child balancer.Picker
+}
+
+func (p *odPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	res, err := p.child.Pick(info)
+	if err != nil {
+		return res, err
+	}
+	wrapped, ok := res.SubConn.(*odSubConn)
+	if !ok {
+		return res, nil
+	}
+
+	p.occ.b.mu.Lock()
+	a, ok := p.occ.b.addrs[wrapped.addr]
+	ejected := ok && a.ejected
+	p.occ.b.mu.Unlock()
+	if ejected {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+
+	childDone := res.Done
+	res.SubConn = wrapped.SubConn
+	res.Done = func(info balancer.DoneInfo) {
+		p.occ.b.mu.Lock()
+		if a, ok := p.occ.b.addrs[wrapped.addr]; ok {
+			if info.Err == nil {
+				a.successes++
+			} else {
+				a.failures++
+			}
+		}
+		p.occ.b.mu.Unlock()
+		if childDone != nil {
+			childDone(info)
+		}
+	}
+	return res, nil
+}
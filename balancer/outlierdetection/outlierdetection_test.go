@@ -0,0 +1,87 @@
+/*
+ *
+ * Copyright 2021 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package outlierdetection
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+)
+
+func newTestBalancer() *odBalancer {
+	return &odBalancer{
+		addrs: make(map[resolver.Address]*addrInfo),
+		rng:   rand.New(rand.NewSource(1)),
+	}
+}
+
+func TestFailurePercentageEjectionHonorsZeroEnforcementPercentage(t *testing.T) {
+	b := newTestBalancer()
+	addr := resolver.Address{Addr: "1.1.1.1"}
+	b.addrs[addr] = &addrInfo{failures: 10}
+
+	cfg := &config{FailurePercentageEjection: &FailurePercentageEjection{
+		Threshold:     1, // any nonzero failure rate qualifies
+		RequestVolume: 1,
+		MinimumHosts:  1,
+		// EnforcementPercentage left at its zero value: per the xDS
+		// message, FailurePercentageEjection never enforces unless
+		// explicitly configured.
+	}}
+
+	var ejectedCount uint32
+	for i := 0; i < 100; i++ {
+		b.applyFailurePercentageEjection(cfg, time.Now(), &ejectedCount, 1)
+	}
+	if b.addrs[addr].ejected {
+		t.Error("address was ejected with EnforcementPercentage unset (0), want never ejected")
+	}
+}
+
+func TestFailurePercentageEjectionFullEnforcementAlwaysEjects(t *testing.T) {
+	b := newTestBalancer()
+	addr := resolver.Address{Addr: "1.1.1.1"}
+	b.addrs[addr] = &addrInfo{failures: 10}
+
+	cfg := &config{FailurePercentageEjection: &FailurePercentageEjection{
+		Threshold:             1,
+		RequestVolume:         1,
+		MinimumHosts:          1,
+		EnforcementPercentage: 100,
+	}}
+
+	var ejectedCount uint32
+	b.applyFailurePercentageEjection(cfg, time.Now(), &ejectedCount, 1)
+	if !b.addrs[addr].ejected {
+		t.Error("address not ejected with EnforcementPercentage=100 and a qualifying failure rate")
+	}
+}
+
+func TestSuccessRateEjectionDefaultsEnforcementPercentageTo100(t *testing.T) {
+	sre := &SuccessRateEjection{}
+	if got := sre.enforcementPercentage(); got != 100 {
+		t.Errorf("enforcementPercentage() with EnforcementPercentage unset = %d, want 100", got)
+	}
+	sre.EnforcementPercentage = 42
+	if got := sre.enforcementPercentage(); got != 42 {
+		t.Errorf("enforcementPercentage() with EnforcementPercentage=42 = %d, want 42", got)
+	}
+}
@@ -0,0 +1,347 @@
+/*
+ *
+ * Copyright 2020 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package p2c implements a power-of-two-choices load balancer weighted by an
+// exponentially-decaying moving average of observed RPC latency.
+//
+// 每次Pick时从Ready的SubConn集合中随机取sampleSize个(默认2个,即传统的
+// power-of-two-choices)，各自计算一个负载分数
+// load = sqrt(lag) * (inflight+1) / success_rate，取分数更低的一个。
+// 为避免长期未被选中的SubConn的延迟数据过期而永远吃亏，超过forcePick
+// 时间未被选中的SubConn会被无条件选中一次(若采样到多个，取最久未被选中的)。
+package p2c
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Name is the name of the p2c_ewma balancer, to be used in the
+// loadBalancingConfig field of a service config.
+const Name = "p2c_ewma"
+
+func init() {
+	balancer.Register(newBuilder())
+}
+
+// config is the balancer config parsed from the loadBalancingConfig JSON for
+// p2c_ewma.
+type config struct {
+	serviceconfig.LoadBalancingConfig
+
+	// DecayMillis is the EWMA decay time constant, in milliseconds: the
+	// previous lag keeps weight exp(-elapsed/decay). Defaults to 600ms.
+	DecayMillis int `json:"decayMillis,omitempty"`
+	// ForcePickMillis is the maximum time a Ready SubConn may go without
+	// being picked before it is chosen unconditionally, in milliseconds.
+	// Defaults to 3000ms.
+	ForcePickMillis int `json:"forcePickMillis,omitempty"`
+	// SampleSize is the number of SubConns sampled per Pick. Defaults to 2;
+	// values less than 2 are treated as 2.
+	SampleSize int `json:"sampleSize,omitempty"`
+}
+
+type p2cBuilder struct{}
+
+func newBuilder() balancer.Builder {
+	return &p2cBuilder{}
+}
+
+func (p2cBuilder) Name() string { return Name }
+
+func (p2cBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	b := &p2cBalancer{
+		cc:        cc,
+		subConns:  make(map[balancer.SubConn]*subConnInfo),
+		decay:     600 * time.Millisecond,
+		forcePick: 3 * time.Second,
+		sample:    2,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	return b
+}
+
+// ParseConfig implements balancer.ConfigParser.
+func (p2cBuilder) ParseConfig(c json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	var cfg config
+	if err := json.Unmarshal(c, &cfg); err != nil {
+		return nil, fmt.Errorf("p2c: unable to unmarshal LB policy config: %v", err)
+	}
+	return &cfg, nil
+}
+
+// subConnInfo is the per-SubConn state used by the p2c+EWMA scoring
+// function. All fields except sc, addr and state are updated atomically since Pick and
+// the Done callbacks it returns run concurrently with each other.
+type subConnInfo struct {
+	sc   balancer.SubConn
+	addr resolver.Address
+
+	lag      uint64 // EWMA of RTT, in nanoseconds.
+	inflight int64  // number of in-flight RPCs.
+	success  uint64 // number of RPCs that completed without error.
+	total    uint64 // number of RPCs that have completed.
+	lastPick int64  // unix nanos of the last time this SubConn was picked.
+
+	state connectivity.State // protected by p2cBalancer.mu
+}
+
+func (sc *subConnInfo) successRate() float64 {
+	total := atomic.LoadUint64(&sc.total)
+	if total == 0 {
+		// Optimistically assume a never-used SubConn is healthy so it gets a
+		// chance to be picked at all.
+		return 1
+	}
+	return float64(atomic.LoadUint64(&sc.success)) / float64(total)
+}
+
+func (sc *subConnInfo) score() float64 {
+	lag := math.Sqrt(float64(atomic.LoadUint64(&sc.lag)))
+	inflight := float64(atomic.LoadInt64(&sc.inflight) + 1)
+	return lag * inflight / sc.successRate()
+}
+
+type p2cBalancer struct {
+	cc balancer.ClientConn
+
+	decay     time.Duration
+	forcePick time.Duration
+	sample    int
+
+	mu       sync.Mutex
+	subConns map[balancer.SubConn]*subConnInfo
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+func (b *p2cBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if cfg, ok := s.BalancerConfig.(*config); ok && cfg != nil {
+		if cfg.DecayMillis > 0 {
+			b.decay = time.Duration(cfg.DecayMillis) * time.Millisecond
+		}
+		if cfg.ForcePickMillis > 0 {
+			b.forcePick = time.Duration(cfg.ForcePickMillis) * time.Millisecond
+		}
+		if cfg.SampleSize >= 2 {
+			b.sample = cfg.SampleSize
+		}
+	}
+
+	addrsSeen := make(map[resolver.Address]bool, len(s.ResolverState.Addresses))
+	b.mu.Lock()
+	for _, a := range s.ResolverState.Addresses {
+		addrsSeen[a] = true
+		if !b.hasAddrLocked(a) {
+			sc, err := b.cc.NewSubConn([]resolver.Address{a}, balancer.NewSubConnOptions{})
+			if err != nil {
+				continue
+			}
+			b.subConns[sc] = &subConnInfo{sc: sc, addr: a}
+			sc.Connect()
+		}
+	}
+	for sc, info := range b.subConns {
+		if !addrsSeen[info.addr] {
+			delete(b.subConns, sc)
+			b.cc.RemoveSubConn(sc)
+		}
+	}
+	b.mu.Unlock()
+
+	b.regeneratePicker()
+	return nil
+}
+
+func (b *p2cBalancer) hasAddrLocked(a resolver.Address) bool {
+	for _, info := range b.subConns {
+		if info.addr == a {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *p2cBalancer) ResolverError(err error) {
+	if len(b.subConns) == 0 {
+		b.cc.UpdateState(balancer.State{
+			ConnectivityState: connectivity.TransientFailure,
+			Picker:            &errPicker{err: err},
+		})
+	}
+}
+
+func (b *p2cBalancer) UpdateSubConnState(sc balancer.SubConn, s balancer.SubConnState) {
+	b.mu.Lock()
+	info, ok := b.subConns[sc]
+	if ok {
+		info.state = s.ConnectivityState
+	}
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+	if s.ConnectivityState == connectivity.Idle {
+		sc.Connect()
+	}
+	b.regeneratePicker()
+}
+
+func (b *p2cBalancer) Close() {}
+
+func (b *p2cBalancer) regeneratePicker() {
+	b.mu.Lock()
+	ready := make([]*subConnInfo, 0, len(b.subConns))
+	for _, info := range b.subConns {
+		if info.state == connectivity.Ready {
+			ready = append(ready, info)
+		}
+	}
+	b.mu.Unlock()
+
+	if len(ready) == 0 {
+		b.cc.UpdateState(balancer.State{ConnectivityState: connectivity.Connecting, Picker: &errPicker{err: balancer.ErrNoSubConnAvailable}})
+		return
+	}
+	b.cc.UpdateState(balancer.State{
+		ConnectivityState: connectivity.Ready,
+		Picker: &p2cPicker{
+			b:     b,
+			ready: ready,
+		},
+	})
+}
+
+type errPicker struct {
+	err error
+}
+
+func (p *errPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	return balancer.PickResult{}, p.err
+}
+
+type p2cPicker struct {
+	b     *p2cBalancer
+	ready []*subConnInfo
+}
+
+func (p *p2cPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	if len(p.ready) == 0 {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+
+	var chosen *subConnInfo
+	if len(p.ready) == 1 {
+		chosen = p.ready[0]
+	} else {
+		now := time.Now()
+		for _, c := range p.sampleN() {
+			switch {
+			case chosen == nil:
+				chosen = c
+			case stale(chosen, now, p.b.forcePick):
+				// A stale entry already beat the rest on forced-pick
+				// grounds; only a more-stale one takes priority over it.
+				if stale(c, now, p.b.forcePick) && c.lastPick < chosen.lastPick {
+					chosen = c
+				}
+			case stale(c, now, p.b.forcePick):
+				chosen = c
+			case c.score() < chosen.score():
+				chosen = c
+			}
+		}
+	}
+
+	pickStart := time.Now()
+	last := atomic.SwapInt64(&chosen.lastPick, pickStart.UnixNano())
+	elapsedSinceLastPick := pickStart.Sub(time.Unix(0, last))
+	atomic.AddInt64(&chosen.inflight, 1)
+
+	return balancer.PickResult{
+		SubConn: chosen.sc,
+		Done: func(info balancer.DoneInfo) {
+			atomic.AddInt64(&chosen.inflight, -1)
+			atomic.AddUint64(&chosen.total, 1)
+			if info.Err == nil {
+				atomic.AddUint64(&chosen.success, 1)
+			}
+			rtt := time.Since(pickStart)
+			updateLag(chosen, rtt, elapsedSinceLastPick, p.b.decay)
+		},
+	}, nil
+}
+
+func stale(sc *subConnInfo, now time.Time, forcePick time.Duration) bool {
+	last := atomic.LoadInt64(&sc.lastPick)
+	if last == 0 {
+		return true
+	}
+	return now.Sub(time.Unix(0, last)) > forcePick
+}
+
+// updateLag applies the EWMA update lag = old*w + rtt*(1-w), where w decays
+// toward 0 the longer it had been since this SubConn was previously picked.
+func updateLag(sc *subConnInfo, rtt, elapsedSinceLastPick time.Duration, decay time.Duration) {
+	w := math.Exp(-float64(elapsedSinceLastPick) / float64(decay))
+	for {
+		old := atomic.LoadUint64(&sc.lag)
+		next := uint64(float64(old)*w + float64(rtt)*(1-w))
+		if atomic.CompareAndSwapUint64(&sc.lag, old, next) {
+			return
+		}
+	}
+}
+
+// sampleN uniformly samples min(p.b.sample, len(p.ready)) distinct entries
+// from p.ready, via a partial Fisher-Yates shuffle of a scratch copy of the
+// index space so that every entry has an equal chance of being included
+// regardless of sample size.
+func (p *p2cPicker) sampleN() []*subConnInfo {
+	n := p.b.sample
+	if n > len(p.ready) {
+		n = len(p.ready)
+	}
+
+	idx := make([]int, len(p.ready))
+	for i := range idx {
+		idx[i] = i
+	}
+
+	p.b.randMu.Lock()
+	out := make([]*subConnInfo, n)
+	for i := 0; i < n; i++ {
+		j := i + p.b.rand.Intn(len(idx)-i)
+		idx[i], idx[j] = idx[j], idx[i]
+		out[i] = p.ready[idx[i]]
+	}
+	p.b.randMu.Unlock()
+
+	return out
+}
@@ -0,0 +1,299 @@
+/*
+ *
+ * Copyright 2021 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package ringhash implements a Ketama-style consistent-hash balancer, for
+// stateful backends (cache shards, session affinity) that need a given
+// PickInfo.HashKey to land on the same SubConn across Picks, as long as the
+// set of Ready SubConns doesn't change.
+//
+// 环(ring)在每次UpdateClientConnState/UpdateSubConnState变化时重建一次，
+// Pick时通过PickInfo.HashKey的xxhash值在环上做二分查找定位起点，
+// 然后顺时针跳过非Ready的SubConn，并对遇到的IDLE SubConn触发Connect()。
+package ringhash
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Name is the name of the ring_hash balancer, to be used in the
+// loadBalancingConfig field of a service config.
+const Name = "ring_hash"
+
+const (
+	defaultMinRingSize = 1024
+	defaultMaxRingSize = 4096
+)
+
+func init() {
+	balancer.Register(builder{})
+}
+
+// config is the balancer config parsed from the loadBalancingConfig JSON for
+// ring_hash.
+type config struct {
+	serviceconfig.LoadBalancingConfig
+
+	MinRingSize uint64 `json:"minRingSize,omitempty"`
+	MaxRingSize uint64 `json:"maxRingSize,omitempty"`
+}
+
+type builder struct{}
+
+func (builder) Name() string { return Name }
+
+func (builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	return &ringhashBalancer{
+		cc:          cc,
+		subConns:    make(map[balancer.SubConn]*endpoint),
+		minRingSize: defaultMinRingSize,
+		maxRingSize: defaultMaxRingSize,
+		rand:        rand.New(rand.NewSource(1)),
+	}
+}
+
+// ParseConfig implements balancer.ConfigParser.
+func (builder) ParseConfig(c json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	var cfg config
+	if err := json.Unmarshal(c, &cfg); err != nil {
+		return nil, fmt.Errorf("ringhash: unable to unmarshal LB policy config: %v", err)
+	}
+	if cfg.MinRingSize > cfg.MaxRingSize && cfg.MaxRingSize != 0 {
+		return nil, fmt.Errorf("ringhash: minRingSize (%v) > maxRingSize (%v)", cfg.MinRingSize, cfg.MaxRingSize)
+	}
+	return &cfg, nil
+}
+
+// endpoint is the per-address state tracked by the balancer.
+type endpoint struct {
+	sc    balancer.SubConn
+	addr  resolver.Address
+	state connectivity.State
+}
+
+type ringhashBalancer struct {
+	cc balancer.ClientConn
+
+	minRingSize, maxRingSize uint64
+
+	mu       sync.Mutex
+	subConns map[balancer.SubConn]*endpoint
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+func (b *ringhashBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if cfg, ok := s.BalancerConfig.(*config); ok && cfg != nil {
+		if cfg.MinRingSize > 0 {
+			b.minRingSize = cfg.MinRingSize
+		}
+		if cfg.MaxRingSize > 0 {
+			b.maxRingSize = cfg.MaxRingSize
+		}
+	}
+
+	b.mu.Lock()
+	addrsSeen := make(map[resolver.Address]bool, len(s.ResolverState.Addresses))
+	for _, a := range s.ResolverState.Addresses {
+		addrsSeen[a] = true
+		if !b.hasAddrLocked(a) {
+			sc, err := b.cc.NewSubConn([]resolver.Address{a}, balancer.NewSubConnOptions{})
+			if err != nil {
+				continue
+			}
+			b.subConns[sc] = &endpoint{sc: sc, addr: a}
+			sc.Connect()
+		}
+	}
+	for sc, ep := range b.subConns {
+		if !addrsSeen[ep.addr] {
+			delete(b.subConns, sc)
+			b.cc.RemoveSubConn(sc)
+		}
+	}
+	b.mu.Unlock()
+
+	b.regeneratePicker()
+	return nil
+}
+
+func (b *ringhashBalancer) hasAddrLocked(a resolver.Address) bool {
+	for _, ep := range b.subConns {
+		if ep.addr == a {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *ringhashBalancer) ResolverError(err error) {
+	b.mu.Lock()
+	empty := len(b.subConns) == 0
+	b.mu.Unlock()
+	if empty {
+		b.cc.UpdateState(balancer.State{ConnectivityState: connectivity.TransientFailure, Picker: &errPicker{err: err}})
+	}
+}
+
+func (b *ringhashBalancer) UpdateSubConnState(sc balancer.SubConn, s balancer.SubConnState) {
+	b.mu.Lock()
+	ep, ok := b.subConns[sc]
+	if ok {
+		ep.state = s.ConnectivityState
+	}
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+	b.regeneratePicker()
+}
+
+func (b *ringhashBalancer) Close() {}
+
+// ringEntry is one point on the consistent-hash ring.
+type ringEntry struct {
+	hash uint64
+	ep   *endpoint
+}
+
+func (b *ringhashBalancer) regeneratePicker() {
+	b.mu.Lock()
+	eps := make([]*endpoint, 0, len(b.subConns))
+	anyReady := false
+	for _, ep := range b.subConns {
+		eps = append(eps, ep)
+		if ep.state == connectivity.Ready {
+			anyReady = true
+		}
+	}
+	b.mu.Unlock()
+
+	if len(eps) == 0 {
+		b.cc.UpdateState(balancer.State{ConnectivityState: connectivity.TransientFailure, Picker: &errPicker{err: balancer.ErrNoSubConnAvailable}})
+		return
+	}
+
+	ring := buildRing(eps, b.minRingSize, b.maxRingSize)
+	state := connectivity.Connecting
+	if anyReady {
+		state = connectivity.Ready
+	}
+	b.cc.UpdateState(balancer.State{
+		ConnectivityState: state,
+		Picker:            &ringhashPicker{b: b, ring: ring, eps: eps},
+	})
+}
+
+// buildRing assigns each endpoint an equal share of pointsPerNode points on
+// the ring, sized so the ring has at least minRingSize entries (capped at
+// maxRingSize), and returns the points sorted by hash. This runs once per
+// state update, in O(N*pointsPerNode).
+func buildRing(eps []*endpoint, minRingSize, maxRingSize uint64) []ringEntry {
+	n := uint64(len(eps))
+	if n == 0 {
+		return nil
+	}
+	pointsPerNode := (minRingSize + n - 1) / n
+	if pointsPerNode == 0 {
+		pointsPerNode = 1
+	}
+	if n*pointsPerNode > maxRingSize && maxRingSize > 0 {
+		pointsPerNode = maxRingSize / n
+		if pointsPerNode == 0 {
+			pointsPerNode = 1
+		}
+	}
+
+	ring := make([]ringEntry, 0, n*pointsPerNode)
+	for _, ep := range eps {
+		for i := uint64(0); i < pointsPerNode; i++ {
+			key := fmt.Sprintf("%s_%d", ep.addr.Addr, i)
+			ring = append(ring, ringEntry{hash: xxhash.Sum64String(key), ep: ep})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+type errPicker struct {
+	err error
+}
+
+func (p *errPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	return balancer.PickResult{}, p.err
+}
+
+type ringhashPicker struct {
+	b    *ringhashBalancer
+	ring []ringEntry
+	eps  []*endpoint
+}
+
+func (p *ringhashPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	if len(p.ring) == 0 {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+	if info.HashKey == "" {
+		return p.randomPick()
+	}
+
+	h := xxhash.Sum64String(info.HashKey)
+	// sort.Search does a binary search for the first ring entry whose hash
+	// is >= h, giving the O(log N) point the key lands on clockwise.
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+
+	for i := 0; i < len(p.ring); i++ {
+		ep := p.ring[(start+i)%len(p.ring)].ep
+		switch ep.state {
+		case connectivity.Ready:
+			return balancer.PickResult{SubConn: ep.sc}, nil
+		case connectivity.Idle:
+			ep.sc.Connect()
+		}
+	}
+	return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+}
+
+func (p *ringhashPicker) randomPick() (balancer.PickResult, error) {
+	ready := make([]*endpoint, 0, len(p.eps))
+	for _, ep := range p.eps {
+		if ep.state == connectivity.Ready {
+			ready = append(ready, ep)
+		} else if ep.state == connectivity.Idle {
+			ep.sc.Connect()
+		}
+	}
+	if len(ready) == 0 {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+	p.b.randMu.Lock()
+	i := p.b.rand.Intn(len(ready))
+	p.b.randMu.Unlock()
+	return balancer.PickResult{SubConn: ready[i].sc}, nil
+}
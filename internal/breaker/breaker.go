@@ -0,0 +1,95 @@
+/*
+ *
+ * Copyright 2020 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package breaker implements the client-side circuit breaking limits
+// described by gRFC A9
+// (https://github.com/grpc/proposal/blob/master/A9-client-side-circuit-breaking.md).
+//
+// 每个方法共享一个Breaker，原始请求与重试/对冲请求分别独立计数，
+// 任一计数超过配置的上限时该次请求在本地被拒绝，不会发往网络。
+package breaker
+
+import (
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/internal/serviceconfig"
+	"google.golang.org/grpc/status"
+)
+
+// Breaker enforces the MaxRequests/MaxPendingRequests/MaxConcurrentRetries
+// limits of a CircuitBreaker policy using atomic counters, so that it can sit
+// on the RPC hot path without taking a lock.
+type Breaker struct {
+	maxRequests uint32
+	maxPending  uint32
+	maxRetries  uint32
+
+	requests uint32
+	pending  uint32
+	retries  uint32
+}
+
+// New creates a Breaker from cfg. A nil cfg is valid and produces a Breaker
+// that never rejects a request.
+func New(cfg *serviceconfig.CircuitBreaker) *Breaker {
+	if cfg == nil {
+		return &Breaker{}
+	}
+	return &Breaker{
+		maxRequests: cfg.MaxRequests,
+		maxPending:  cfg.MaxPendingRequests,
+		maxRetries:  cfg.MaxConcurrentRetries,
+	}
+}
+
+// StartRequest attempts to admit a new primary (non-retry, non-hedge)
+// request. It returns an error with codes.Unavailable if MaxRequests would be
+// exceeded; otherwise it returns a done func that must be called exactly
+// once when the request completes.
+func (b *Breaker) StartRequest() (done func(), err error) {
+	return start(&b.requests, b.maxRequests)
+}
+
+// StartPending attempts to admit a request that is queued waiting for a
+// connection or a slot from StartRequest, counted against
+// MaxPendingRequests.
+func (b *Breaker) StartPending() (done func(), err error) {
+	return start(&b.pending, b.maxPending)
+}
+
+// StartRetry attempts to admit a new retry or hedge attempt, counted against
+// MaxConcurrentRetries independently of StartRequest.
+func (b *Breaker) StartRetry() (done func(), err error) {
+	return start(&b.retries, b.maxRetries)
+}
+
+func start(counter *uint32, max uint32) (func(), error) {
+	if max == 0 {
+		return func() {}, nil
+	}
+	for {
+		cur := atomic.LoadUint32(counter)
+		if cur >= max {
+			return nil, status.Error(codes.Unavailable, "circuit breaker open")
+		}
+		if atomic.CompareAndSwapUint32(counter, cur, cur+1) {
+			return func() { atomic.AddUint32(counter, ^uint32(0)) }, nil
+		}
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ *
+ * Copyright 2020 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package healthcheck implements the gRPC-native subchannel health-checking
+// client described by
+// https://github.com/grpc/grpc/blob/master/doc/health-checking.md.
+//
+// 它为一个subchannel开启一个到grpc.health.v1.Health/Watch的流，并在watch的
+// service变为NOT_SERVING时将subchannel标记为TRANSIENT_FAILURE。Manager管理
+// 这些watch的生命周期，供持有SubConn的实现(如addrConn)据NewSubConnOptions
+// 中配置的HealthChecker按SubConn启动/停止健康检查。
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	balancer.RegisterHealthChecker(Checker{})
+}
+
+// Func watches the health of serviceName on the stream returned by newStream,
+// invoking setConnectivityState whenever the reported status changes. It
+// blocks until ctx is done or the stream fails unrecoverably.
+//
+// newStream is provided by the subchannel wrapper rather than a concrete
+// *grpc.ClientConn so that this package stays decoupled from the transport
+// that owns the connection.
+type Func func(ctx context.Context, newStream func(string) (interface{}, error), setConnectivityState func(connectivity.State, error), serviceName string) error
+
+// Default is the Func used for a subchannel's health check unless overridden,
+// implementing the gRPC-native health-checking protocol.
+func Default(ctx context.Context, newStream func(string) (interface{}, error), setConnectivityState func(connectivity.State, error), serviceName string) error {
+	backoff := time.Second
+	for {
+		if err := watchOnce(ctx, newStream, setConnectivityState, serviceName); err != nil {
+			setConnectivityState(connectivity.Connecting, nil)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func watchOnce(ctx context.Context, newStream func(string) (interface{}, error), setConnectivityState func(connectivity.State, error), serviceName string) error {
+	rawStream, err := newStream("/grpc.health.v1.Health/Watch")
+	if err != nil {
+		return fmt.Errorf("healthcheck: error creating stream: %v", err)
+	}
+	stream, ok := rawStream.(healthWatchClientStream)
+	if !ok {
+		return fmt.Errorf("healthcheck: newStream returned unexpected type %T", rawStream)
+	}
+	if err := stream.SendMsg(&healthpb.HealthCheckRequest{Service: serviceName}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		resp := new(healthpb.HealthCheckResponse)
+		err := stream.RecvMsg(resp)
+		if err != nil {
+			if status.Code(err) == codes.Unimplemented {
+				// The server doesn't implement the health-checking protocol
+				// at all; treat the subchannel as always healthy, matching
+				// the legacy HealthCheckEnabled=false behavior.
+				setConnectivityState(connectivity.Ready, nil)
+				return nil
+			}
+			if err == io.EOF {
+				return nil
+			}
+			setConnectivityState(connectivity.TransientFailure, err)
+			return err
+		}
+		switch resp.Status {
+		case healthpb.HealthCheckResponse_SERVING:
+			setConnectivityState(connectivity.Ready, nil)
+		default:
+			setConnectivityState(connectivity.TransientFailure, fmt.Errorf("healthcheck: service %q is %v", serviceName, resp.Status))
+		}
+	}
+}
+
+// healthWatchClientStream is the subset of grpc.ClientStream that Default
+// needs; it is satisfied by the *grpc.ClientStream returned from newStream.
+type healthWatchClientStream interface {
+	SendMsg(m interface{}) error
+	RecvMsg(m interface{}) error
+	CloseSend() error
+}
+
+// newStreamContextKey is the context key under which the SubConn wrapper
+// passes its stream factory to Checker.Watch.
+type newStreamContextKey struct{}
+
+// NewContextWithNewStream returns a copy of ctx carrying newStream, so that
+// Checker.Watch (or any other balancer.HealthChecker wanting to speak the
+// gRPC-native health protocol) can open a stream on the SubConn's
+// connection.
+func NewContextWithNewStream(ctx context.Context, newStream func(string) (interface{}, error)) context.Context {
+	return context.WithValue(ctx, newStreamContextKey{}, newStream)
+}
+
+// Checker is the default balancer.HealthChecker, registered under the name
+// "grpc". It implements the gRPC-native health-checking protocol described
+// by this package's doc comment.
+type Checker struct{}
+
+// Name returns "grpc".
+func (Checker) Name() string { return "grpc" }
+
+// Watch implements balancer.HealthChecker.
+func (Checker) Watch(ctx context.Context, serviceName string, report func(connectivity.State, error)) error {
+	newStream, ok := ctx.Value(newStreamContextKey{}).(func(string) (interface{}, error))
+	if !ok {
+		return fmt.Errorf("healthcheck: no stream factory attached to context")
+	}
+	return Default(ctx, newStream, report, serviceName)
+}
+
+// Manager runs a balancer.HealthChecker's Watch for each SubConn it is
+// started for, the way a concrete SubConn wrapper would: one per SubConn,
+// restarted with backoff if Watch returns (HealthChecker implementations
+// besides Checker are not guaranteed to loop forever the way Default does),
+// until Stop is called for that SubConn.
+type Manager struct {
+	mu      sync.Mutex
+	cancels map[balancer.SubConn]context.CancelFunc
+}
+
+// NewManager creates a Manager with nothing running.
+func NewManager() *Manager {
+	return &Manager{cancels: make(map[balancer.SubConn]context.CancelFunc)}
+}
+
+// Start begins health-checking sc with hc if it isn't already being
+// checked, opening streams via newStream and reporting state transitions to
+// report. It is a no-op if sc is already being checked; call Stop first to
+// restart it with a different HealthChecker or serviceName.
+func (m *Manager) Start(sc balancer.SubConn, hc balancer.HealthChecker, serviceName string, newStream func(string) (interface{}, error), report func(connectivity.State, error)) {
+	m.mu.Lock()
+	if _, ok := m.cancels[sc]; ok {
+		m.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(NewContextWithNewStream(context.Background(), newStream))
+	m.cancels[sc] = cancel
+	m.mu.Unlock()
+
+	go func() {
+		for ctx.Err() == nil {
+			if err := hc.Watch(ctx, serviceName, report); err != nil && ctx.Err() == nil {
+				report(connectivity.Connecting, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+}
+
+// Stop ends health-checking for sc, if it is being checked.
+func (m *Manager) Stop(sc balancer.SubConn) {
+	m.mu.Lock()
+	cancel, ok := m.cancels[sc]
+	delete(m.cancels, sc)
+	m.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ *
+ * Copyright 2023 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package healthcheck
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+)
+
+type fakeSubConn struct{ balancer.SubConn }
+
+// fakeHealthStream reports SERVING once, then blocks until ctx is canceled.
+type fakeHealthStream struct {
+	ctx  context.Context
+	sent bool
+}
+
+func (s *fakeHealthStream) SendMsg(m interface{}) error { return nil }
+func (s *fakeHealthStream) CloseSend() error            { return nil }
+func (s *fakeHealthStream) RecvMsg(m interface{}) error {
+	if !s.sent {
+		s.sent = true
+		*m.(*healthpb.HealthCheckResponse) = healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}
+		return nil
+	}
+	<-s.ctx.Done()
+	return s.ctx.Err()
+}
+
+func TestManagerStartReportsServing(t *testing.T) {
+	sc := fakeSubConn{}
+
+	var mu sync.Mutex
+	var states []connectivity.State
+	report := func(s connectivity.State, _ error) {
+		mu.Lock()
+		states = append(states, s)
+		mu.Unlock()
+	}
+
+	newStream := func(method string) (interface{}, error) {
+		return &fakeHealthStream{ctx: context.Background()}, nil
+	}
+
+	m := NewManager()
+	m.Start(sc, Checker{}, "", newStream, report)
+	defer m.Stop(sc)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(states)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(states) == 0 || states[0] != connectivity.Ready {
+		t.Fatalf("states = %v, want first state %v", states, connectivity.Ready)
+	}
+}
+
+func TestManagerStartIsIdempotentPerSubConn(t *testing.T) {
+	sc := fakeSubConn{}
+	newStream := func(method string) (interface{}, error) {
+		return &fakeHealthStream{ctx: context.Background()}, nil
+	}
+
+	m := NewManager()
+	m.Start(sc, Checker{}, "", newStream, func(connectivity.State, error) {})
+	m.Start(sc, Checker{}, "", newStream, func(connectivity.State, error) {})
+
+	m.mu.Lock()
+	n := len(m.cancels)
+	m.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("len(cancels) = %d after two Starts for the same SubConn, want 1", n)
+	}
+
+	m.Stop(sc)
+	m.mu.Lock()
+	_, ok := m.cancels[sc]
+	m.mu.Unlock()
+	if ok {
+		t.Error("cancels still contains sc after Stop")
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ *
+ * Copyright 2023 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package retry ties a MethodConfig's RetryPolicy/HedgingPolicy and
+// CircuitBreaker together into the per-attempt admission and backoff
+// decisions a ClientStream makes, as described by gRFC A6
+// (https://github.com/grpc/proposal/blob/master/A6-client-retries.md) and
+// gRFC A9 (https://github.com/grpc/proposal/blob/master/A9-client-side-circuit-breaking.md).
+//
+// 一个ClientStream在发起每次attempt前调用Gate.StartAttempt决定是否允许该次attempt
+// (受CircuitBreaker限制，原始请求计入MaxRequests，重试/对冲计入
+// MaxConcurrentRetries)；在attempt失败后调用Gate.NextRetryBackoff或
+// Gate.NextHedgeDelay决定是否以及何时发起下一次attempt，其中重试与对冲还受
+// RetryThrottlingPolicy对应的共享Throttler限制。
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/internal/breaker"
+	"google.golang.org/grpc/internal/serviceconfig"
+	"google.golang.org/grpc/internal/throttle"
+)
+
+// Gate is the per-method admission and backoff policy built from a
+// MethodConfig, shared by every ClientStream made to that method the way
+// the RetryPolicy/HedgingPolicy/CircuitBreaker it was built from is shared.
+type Gate struct {
+	breaker *breaker.Breaker
+
+	retry    *serviceconfig.RetryPolicy
+	hedge    *serviceconfig.HedgingPolicy
+	throttle *throttle.Throttler // nil if the ClientConn has no retryThrottling policy
+}
+
+// NewGate creates a Gate from mc's CircuitBreaker, RetryPolicy and
+// HedgingPolicy. throttler is the Throttler shared by every method of the
+// ClientConn mc belongs to, or nil if the service config set no
+// retryThrottling policy.
+func NewGate(mc *serviceconfig.MethodConfig, throttler *throttle.Throttler) *Gate {
+	return &Gate{
+		breaker:  breaker.New(mc.CircuitBreaker),
+		retry:    mc.RetryPolicy,
+		hedge:    mc.HedgingPolicy,
+		throttle: throttler,
+	}
+}
+
+// StartAttempt admits a new attempt, counting a retry or hedge against
+// MaxConcurrentRetries and a first attempt against MaxRequests. It returns
+// an error with codes.Unavailable if the relevant limit has been reached;
+// otherwise it returns a done func that must be called exactly once with
+// the attempt's status code when it completes, recording its outcome with
+// the Throttler if one is configured: a token is added on codes.OK, and
+// subtracted on a retryable failure (per RetryPolicy.RetryableStatusCodes)
+// or a non-committing hedge failure (per ShouldCommit), whichever policy mc
+// was built from has.
+func (g *Gate) StartAttempt(isRetry bool) (done func(code codes.Code), err error) {
+	var end func()
+	if isRetry {
+		end, err = g.breaker.StartRetry()
+	} else {
+		end, err = g.breaker.StartRequest()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func(code codes.Code) {
+		end()
+		g.recordOutcome(code)
+	}, nil
+}
+
+// recordOutcome feeds a completed attempt's status code to the Throttler,
+// if one is configured, per gRFC A6: a token is added on every successful
+// RPC, and subtracted on every failed RPC whose code counts as a failure
+// under whichever policy is active -- retryable per RetryPolicy for a
+// retried method, or non-committing per HedgingPolicy.NonFatalStatusCodes
+// for a hedged one.
+func (g *Gate) recordOutcome(code codes.Code) {
+	if g.throttle == nil {
+		return
+	}
+	switch {
+	case code == codes.OK:
+		g.throttle.OnSuccess()
+	case g.retry != nil && g.retry.RetryableStatusCodes[code]:
+		g.throttle.OnFailure()
+	case g.hedge != nil && !g.ShouldCommit(code):
+		g.throttle.OnFailure()
+	}
+}
+
+// ShouldCommit reports whether an attempt completing with code should be
+// committed and returned to the caller (canceling any other outstanding
+// hedges), per HedgingPolicy.NonFatalStatusCodes: a code in that set is
+// instead treated as a failure that does not stop the remaining hedges, so
+// the hedge-completion path should await (or start) another attempt rather
+// than returning this one's result. With no HedgingPolicy configured, every
+// code commits.
+func (g *Gate) ShouldCommit(code codes.Code) bool {
+	if g.hedge == nil {
+		return true
+	}
+	return !g.hedge.NonFatalStatusCodes[code]
+}
+
+// NextRetryBackoff reports the random(0, backoff) delay before sending the
+// next retry, given that attempt attempts (including the original RPC,
+// so 1 after the original RPC's first failure) have been made so far, and
+// whether that retry is allowed at all: it is not if code isn't retryable,
+// MaxAttempts has been reached, or the Throttler has suppressed further
+// retries. Whenever it refuses a retryable code, and a Throttler is
+// configured, it also records the drop with OnFailure, per gRFC A6's
+// "subtract a token when a retry is dropped"; refusing a non-retryable code
+// records nothing.
+func (g *Gate) NextRetryBackoff(attempt int, code codes.Code) (time.Duration, bool) {
+	if g.retry == nil || !g.retry.RetryableStatusCodes[code] {
+		return 0, false
+	}
+	if attempt >= g.retry.MaxAttempts {
+		g.onDrop()
+		return 0, false
+	}
+	if g.throttle != nil && !g.throttle.ShouldRetry() {
+		g.onDrop()
+		return 0, false
+	}
+
+	backoff := float64(g.retry.InitialBackoff) * math.Pow(g.retry.BackoffMultiplier, float64(attempt-1))
+	if max := float64(g.retry.MaxBackoff); backoff > max {
+		backoff = max
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1)), true
+}
+
+// NextHedgeDelay reports the delay before sending the next hedge after the
+// previous attempt, given that attempt attempts (including the original
+// RPC) are already outstanding, and whether that hedge is allowed at all:
+// it is not once MaxAttempts has been reached, or while the Throttler has
+// suppressed further attempts. Whenever it refuses, and a Throttler is
+// configured, it also records the drop with OnFailure.
+func (g *Gate) NextHedgeDelay(attempt int) (time.Duration, bool) {
+	if g.hedge == nil || attempt >= g.hedge.MaxAttempts {
+		g.onDrop()
+		return 0, false
+	}
+	if g.throttle != nil && !g.throttle.ShouldRetry() {
+		g.onDrop()
+		return 0, false
+	}
+	return g.hedge.HedgingDelay, true
+}
+
+// onDrop records a dropped retry/hedge attempt with the Throttler, if one
+// is configured.
+func (g *Gate) onDrop() {
+	if g.throttle != nil {
+		g.throttle.OnFailure()
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ *
+ * Copyright 2023 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package retry
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/internal/serviceconfig"
+	"google.golang.org/grpc/internal/throttle"
+)
+
+func TestGateCircuitBreakerRejectsOverLimit(t *testing.T) {
+	g := NewGate(&serviceconfig.MethodConfig{
+		CircuitBreaker: &serviceconfig.CircuitBreaker{MaxRequests: 1},
+	}, nil)
+
+	done1, err := g.StartAttempt(false)
+	if err != nil {
+		t.Fatalf("first StartAttempt failed: %v", err)
+	}
+	if _, err := g.StartAttempt(false); err == nil {
+		t.Fatal("second concurrent StartAttempt succeeded, want codes.Unavailable")
+	}
+
+	done1(codes.OK)
+	if _, err := g.StartAttempt(false); err != nil {
+		t.Fatalf("StartAttempt after the first completed failed: %v", err)
+	}
+}
+
+func TestGateNextRetryBackoffHonorsThrottler(t *testing.T) {
+	tr := throttle.NewThrottler(&serviceconfig.RetryThrottlingPolicy{MaxTokens: 2, TokenRatio: 1})
+	g := NewGate(&serviceconfig.MethodConfig{
+		RetryPolicy: &serviceconfig.RetryPolicy{
+			MaxAttempts:          5,
+			InitialBackoff:       10 * time.Millisecond,
+			MaxBackoff:           time.Second,
+			BackoffMultiplier:    2,
+			RetryableStatusCodes: map[codes.Code]bool{codes.Unavailable: true},
+		},
+	}, tr)
+
+	if _, ok := g.NextRetryBackoff(1, codes.InvalidArgument); ok {
+		t.Error("NextRetryBackoff allowed a non-retryable code")
+	}
+
+	if _, ok := g.NextRetryBackoff(1, codes.Unavailable); !ok {
+		t.Error("NextRetryBackoff rejected a retryable attempt under MaxAttempts with tokens available")
+	}
+
+	// Drive the shared throttler below half its tokens; further retries
+	// should now be suppressed even though MaxAttempts hasn't been reached.
+	done, _ := g.StartAttempt(true)
+	done(codes.Unavailable)
+	done, _ = g.StartAttempt(true)
+	done(codes.Unavailable)
+
+	if _, ok := g.NextRetryBackoff(2, codes.Unavailable); ok {
+		t.Error("NextRetryBackoff allowed a retry after the throttler was exhausted")
+	}
+}
+
+func TestGateNextRetryBackoffDropRecordsOnFailure(t *testing.T) {
+	// MaxTokens=4 with a single retryable failure leaves tokens above the
+	// suppression threshold (MaxTokens/2); NextRetryBackoff refusing once
+	// MaxAttempts is reached should still cost a token via onDrop, pushing
+	// tokens down to that threshold, which suppresses a *following* retry.
+	tr := throttle.NewThrottler(&serviceconfig.RetryThrottlingPolicy{MaxTokens: 4, TokenRatio: 1})
+	g := NewGate(&serviceconfig.MethodConfig{
+		RetryPolicy: &serviceconfig.RetryPolicy{
+			MaxAttempts:          2,
+			InitialBackoff:       10 * time.Millisecond,
+			MaxBackoff:           time.Second,
+			BackoffMultiplier:    2,
+			RetryableStatusCodes: map[codes.Code]bool{codes.Unavailable: true},
+		},
+	}, tr)
+
+	done, _ := g.StartAttempt(true)
+	done(codes.Unavailable)
+
+	if _, ok := g.NextRetryBackoff(2, codes.Unavailable); ok {
+		t.Fatal("NextRetryBackoff allowed a 3rd attempt past MaxAttempts=2")
+	}
+	if _, ok := g.NextRetryBackoff(1, codes.Unavailable); ok {
+		t.Error("NextRetryBackoff allowed a retry after the dropped attempt should have exhausted the throttler")
+	}
+}
+
+func TestGateNextHedgeDelayStopsAtMaxAttempts(t *testing.T) {
+	g := NewGate(&serviceconfig.MethodConfig{
+		HedgingPolicy: &serviceconfig.HedgingPolicy{MaxAttempts: 3, HedgingDelay: 5 * time.Millisecond},
+	}, nil)
+
+	if d, ok := g.NextHedgeDelay(1); !ok || d != 5*time.Millisecond {
+		t.Errorf("NextHedgeDelay(1) = (%v, %v), want (%v, true)", d, ok, 5*time.Millisecond)
+	}
+	if _, ok := g.NextHedgeDelay(3); ok {
+		t.Error("NextHedgeDelay(3) allowed a 4th attempt past MaxAttempts=3")
+	}
+}
+
+func TestGateShouldCommit(t *testing.T) {
+	g := NewGate(&serviceconfig.MethodConfig{
+		HedgingPolicy: &serviceconfig.HedgingPolicy{
+			MaxAttempts:         3,
+			HedgingDelay:        5 * time.Millisecond,
+			NonFatalStatusCodes: map[codes.Code]bool{codes.Unavailable: true},
+		},
+	}, nil)
+
+	if !g.ShouldCommit(codes.OK) {
+		t.Error("ShouldCommit(OK) = false, want true")
+	}
+	if g.ShouldCommit(codes.Unavailable) {
+		t.Error("ShouldCommit(Unavailable) = true, want false: Unavailable is a NonFatalStatusCode")
+	}
+	if !g.ShouldCommit(codes.DeadlineExceeded) {
+		t.Error("ShouldCommit(DeadlineExceeded) = false, want true: not a NonFatalStatusCode")
+	}
+
+	g2 := NewGate(&serviceconfig.MethodConfig{}, nil)
+	if !g2.ShouldCommit(codes.Unavailable) {
+		t.Error("ShouldCommit with no HedgingPolicy = false, want true")
+	}
+}
+
+func TestGateRecordOutcomeDecrementsOnNonFatalHedgeFailure(t *testing.T) {
+	tr := throttle.NewThrottler(&serviceconfig.RetryThrottlingPolicy{MaxTokens: 2, TokenRatio: 1})
+	g := NewGate(&serviceconfig.MethodConfig{
+		HedgingPolicy: &serviceconfig.HedgingPolicy{
+			MaxAttempts:         5,
+			HedgingDelay:        5 * time.Millisecond,
+			NonFatalStatusCodes: map[codes.Code]bool{codes.Unavailable: true},
+		},
+	}, tr)
+
+	done, _ := g.StartAttempt(true)
+	done(codes.Unavailable)
+	done, _ = g.StartAttempt(true)
+	done(codes.Unavailable)
+
+	if tr.ShouldRetry() {
+		t.Error("throttler still allows retries after two non-fatal hedge failures exhausted its tokens")
+	}
+}
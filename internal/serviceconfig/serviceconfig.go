@@ -51,10 +51,10 @@ type intermediateBalancerConfig []map[string]json.RawMessage
 // ServiceConfig contains a list of loadBalancingConfigs, each with a name and
 // config. This method iterates through that list in order, and stops at the
 // first policy that is supported.
-// - If the config for the first supported policy is invalid, the whole service
-//   config is invalid.
-// - If the list doesn't contain any supported policy, the whole service config
-//   is invalid.
+//   - If the config for the first supported policy is invalid, the whole service
+//     config is invalid.
+//   - If the list doesn't contain any supported policy, the whole service config
+//     is invalid.
 func (bc *BalancerConfig) UnmarshalJSON(b []byte) error {
 	var ir intermediateBalancerConfig
 	err := json.Unmarshal(b, &ir)
@@ -123,6 +123,41 @@ type MethodConfig struct {
 	MaxRespSize *int
 	// RetryPolicy 为方法配置重试选项
 	RetryPolicy *RetryPolicy
+	// HedgingPolicy 为方法配置对冲(hedging)选项。 RetryPolicy与HedgingPolicy只能二选一，
+	// 两者同时配置时该方法的配置被视为无效。
+	HedgingPolicy *HedgingPolicy
+	// CircuitBreaker 为方法配置gRFC A9客户端熔断选项。 为nil表示不对此方法做并发限制。
+	CircuitBreaker *CircuitBreaker
+}
+
+// CircuitBreaker defines the go-native version of the client-side circuit
+// breaking limits described by gRFC A9
+// (https://github.com/grpc/proposal/blob/master/A9-client-side-circuit-breaking.md).
+//
+// Limits are tracked as atomic counters shared by every RPC made to the
+// method; an RPC that would exceed its limit fails locally with
+// codes.Unavailable instead of being sent.
+type CircuitBreaker struct {
+	// MaxRequests is the maximum number of outstanding (primary, i.e.
+	// non-retry/hedge) requests allowed at one time. Zero means no limit.
+	MaxRequests uint32
+	// MaxPendingRequests is the maximum number of requests that may be
+	// queued waiting to be sent. Zero means no limit.
+	MaxPendingRequests uint32
+	// MaxConcurrentRetries is the maximum number of outstanding retry or
+	// hedge attempts allowed at one time, tracked separately from
+	// MaxRequests. Zero means no limit.
+	MaxConcurrentRetries uint32
+}
+
+// HealthCheckConfig contains the service config fields related to health
+// checking, as described by https://github.com/grpc/grpc/blob/master/doc/health-checking.md.
+type HealthCheckConfig struct {
+	// ServiceName is the service name to use in the health-checking request.
+	// A subchannel watching this service via grpc.health.v1.Health/Watch is
+	// moved to connectivity.TransientFailure whenever the watched service
+	// reports NOT_SERVING.
+	ServiceName string
 }
 
 // RetryPolicy defines the go-native version of the retry policy defined by the
@@ -152,3 +187,72 @@ type RetryPolicy struct {
 	// Note: a set is used to store this for easy lookup.
 	RetryableStatusCodes map[codes.Code]bool
 }
+
+// RetryThrottlingPolicy determines the retry throttling policy for all RPCs
+// made through a ClientConn, as defined by the service config here:
+// https://github.com/grpc/proposal/blob/master/A6-client-retries.md#integration-with-service-config
+type RetryThrottlingPolicy struct {
+	// MaxTokens is the maximum number of tokens the token bucket will hold.
+	// This field is required and must be in the range (0, 1000], with up to
+	// 3 decimal places of precision allowed.
+	MaxTokens float64
+	// TokenRatio is the amount of tokens added to the token bucket on every
+	// successful RPC. Typically this will be some number between 0 and 1,
+	// e.g., 0.1. This field is required.
+	TokenRatio float64
+}
+
+// HedgingPolicy defines the go-native version of the hedging policy defined
+// by the service config here:
+// https://github.com/grpc/proposal/blob/master/A6-client-retries.md#hedging-policy
+//
+// Unlike a retry, a hedged attempt is sent without waiting for a previous
+// attempt to fail: the first attempt is sent immediately, and if it has not
+// committed within HedgingDelay, a second attempt is sent in parallel, and so
+// on up to MaxAttempts. The first attempt whose status code is not in
+// NonFatalStatusCodes is committed; the remaining in-flight attempts are
+// cancelled.
+type HedgingPolicy struct {
+	// MaxAttempts is the maximum number of hedged attempts, including the
+	// original RPC.
+	//
+	// This field is required and must be two or greater.
+	MaxAttempts int
+
+	// HedgingDelay is the length of time to wait before sending a new hedge.
+	// Set this to 0 to immediately send all hedges.
+	HedgingDelay time.Duration
+
+	// NonFatalStatusCodes is the set of status codes which indicate other
+	// hedges may still succeed. If a non-fatal status code is returned by the
+	// server, hedged RPCs will continue. Otherwise, outstanding requests will
+	// be canceled and the error returned to the client application layer.
+	//
+	// Status codes are specified as strings, e.g., "UNAVAILABLE".
+	NonFatalStatusCodes map[codes.Code]bool
+}
+
+// validatePolicies enforces that a method does not configure both RetryPolicy
+// and HedgingPolicy at once, per the A6 gRFC: a method may retry or hedge,
+// but the two failure-recovery strategies are mutually exclusive.
+func (mc *MethodConfig) validatePolicies() error {
+	if mc.RetryPolicy != nil && mc.HedgingPolicy != nil {
+		return fmt.Errorf("method config has both retryPolicy and hedgingPolicy; a method may set at most one")
+	}
+	return nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+//
+// It decodes into the plain field set of MethodConfig and then rejects
+// configs that set both RetryPolicy and HedgingPolicy, since the two are
+// mutually exclusive per the service config spec.
+func (mc *MethodConfig) UnmarshalJSON(b []byte) error {
+	type plainMC MethodConfig
+	var pmc plainMC
+	if err := json.Unmarshal(b, &pmc); err != nil {
+		return err
+	}
+	*mc = MethodConfig(pmc)
+	return mc.validatePolicies()
+}
@@ -0,0 +1,97 @@
+/*
+ *
+ * Copyright 2020 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package throttle implements the retry throttling token bucket described by
+// gRFC A6 (https://github.com/grpc/proposal/blob/master/A6-client-retries.md#retry-throttling).
+//
+// One Throttler is created per server (keyed by resolved authority/target)
+// and shared by every RetryPolicy/HedgingPolicy attempt made against that
+// server, so that a server-wide failure suppresses additional retries and
+// hedges across all streams rather than just the stream that observed it.
+package throttle
+
+import (
+	"sync/atomic"
+
+	"google.golang.org/grpc/internal/serviceconfig"
+)
+
+// Throttler tracks the token count described by a RetryThrottlingPolicy and
+// decides whether an additional retry or hedge attempt is currently allowed.
+//
+// All methods are safe for concurrent use by multiple goroutines, as is
+// required since many streams on the same ClientConn share one Throttler.
+type Throttler struct {
+	// maxTokens and tokenRatioMilli are fixed at construction time from the
+	// RetryThrottlingPolicy; tokens is the only field that changes after
+	// NewThrottler returns. All three, along with the floating-point token
+	// count, are stored scaled by 1000 (the 3 decimal places of precision
+	// gRFC A6 requires) so that the shared counter can be updated with an
+	// atomic compare-and-swap loop, avoiding a mutex on the RPC hot path.
+	maxTokens       int64
+	tokenRatioMilli int64
+	tokens          int64
+}
+
+// NewThrottler creates a Throttler from the given policy. MaxTokens must be
+// greater than 0 and at most 1000; TokenRatio must be non-negative.
+func NewThrottler(policy *serviceconfig.RetryThrottlingPolicy) *Throttler {
+	max := int64(policy.MaxTokens * 1000)
+	return &Throttler{
+		maxTokens:       max,
+		tokenRatioMilli: int64(policy.TokenRatio * 1000),
+		tokens:          max,
+	}
+}
+
+// OnFailure subtracts a token, as required whenever an RPC fails with a
+// retryable status, or a retry/hedge is dropped instead of being sent.
+func (t *Throttler) OnFailure() {
+	t.add(-1000)
+}
+
+// OnSuccess adds the policy's TokenRatio tokens, as required on every
+// successful RPC.
+func (t *Throttler) OnSuccess() {
+	t.add(t.tokenRatioMilli)
+}
+
+// add atomically adjusts the token count by deltaMilli (in thousandths of a
+// token), clamping the result to [0, maxTokens].
+func (t *Throttler) add(deltaMilli int64) {
+	for {
+		old := atomic.LoadInt64(&t.tokens)
+		next := old + deltaMilli
+		if next > t.maxTokens {
+			next = t.maxTokens
+		}
+		if next < 0 {
+			next = 0
+		}
+		if atomic.CompareAndSwapInt64(&t.tokens, old, next) {
+			return
+		}
+	}
+}
+
+// ShouldRetry reports whether a new retry or hedge attempt may be scheduled.
+// Per gRFC A6, additional attempts are suppressed once the token count drops
+// to or below maxTokens/2; the original attempt is never affected.
+func (t *Throttler) ShouldRetry() bool {
+	return atomic.LoadInt64(&t.tokens) > t.maxTokens/2
+}
@@ -0,0 +1,56 @@
+/*
+ *
+ * Copyright 2023 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package throttle
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/internal/serviceconfig"
+)
+
+func TestThrottlerHalfThresholdEdge(t *testing.T) {
+	tr := NewThrottler(&serviceconfig.RetryThrottlingPolicy{MaxTokens: 4, TokenRatio: 1})
+	if !tr.ShouldRetry() {
+		t.Fatalf("ShouldRetry() = false at full tokens, want true")
+	}
+
+	// Two failures bring tokens from 4 to 2, exactly maxTokens/2: per gRFC
+	// A6 this must suppress further retries.
+	tr.OnFailure()
+	tr.OnFailure()
+	if tr.ShouldRetry() {
+		t.Errorf("ShouldRetry() = true at tokens == maxTokens/2, want false")
+	}
+
+	// A success pushes tokens back above the threshold.
+	tr.OnSuccess()
+	if !tr.ShouldRetry() {
+		t.Errorf("ShouldRetry() = false after OnSuccess pushed tokens above threshold, want true")
+	}
+}
+
+func TestThrottlerClampsToMaxTokens(t *testing.T) {
+	tr := NewThrottler(&serviceconfig.RetryThrottlingPolicy{MaxTokens: 2, TokenRatio: 1})
+	for i := 0; i < 10; i++ {
+		tr.OnSuccess()
+	}
+	if got := tr.tokens; got != tr.maxTokens {
+		t.Errorf("tokens = %d after repeated OnSuccess, want clamped to maxTokens %d", got, tr.maxTokens)
+	}
+}
@@ -0,0 +1,363 @@
+/*
+ *
+ * Copyright 2020 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package dns implements a dns resolver to be installed as the default
+// resolver in grpc.
+//
+// 该resolver解析形如"dns://[authority/]host[:port]"的target: 对host进行A/AAAA
+// 查询得到地址列表；对"_grpc_config.<host>"进行TXT查询以获取服务端建议的service
+// config(见naming.md)。
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+func init() {
+	resolver.Register(NewBuilder())
+}
+
+const (
+	defaultPort       = "443"
+	defaultDNSSvrPort = "53"
+	// txtPrefix is the prefix of the TXT record value holding the
+	// gRPC-defined service config choices.
+	txtPrefix = "grpc_config="
+	// txtAttribute is the prefix of the TXT record name queried for service
+	// config, as defined in naming.md: _grpc_config.<host>.
+	txtAttribute     = "_grpc_config."
+	minDNSResRate    = 30 * time.Second
+	maxDNSResBackoff = 120 * time.Second
+)
+
+var (
+	// newNetResolver can be overridden in tests to plug in a fake resolver.
+	newNetResolver = func(authority string) (*net.Resolver, error) {
+		if authority == "" {
+			return net.DefaultResolver, nil
+		}
+		host, port, err := parseTarget(authority, defaultDNSSvrPort)
+		if err != nil {
+			return nil, err
+		}
+		authorityWithPort := net.JoinHostPort(host, port)
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, authorityWithPort)
+			},
+		}, nil
+	}
+)
+
+type builder struct{}
+
+// NewBuilder creates a dnsBuilder which is used to factory DNS resolvers.
+func NewBuilder() resolver.Builder {
+	return &builder{}
+}
+
+func (b *builder) Scheme() string {
+	return "dns"
+}
+
+// Build creates and starts a DNS resolver that watches the name resolution
+// of the target.
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	host, port, err := parseTarget(target.Endpoint, defaultPort)
+	if err != nil {
+		return nil, err
+	}
+
+	netResolver, err := newNetResolver(target.Authority)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &dnsResolver{
+		host:                 host,
+		port:                 port,
+		ctx:                  ctx,
+		cancel:               cancel,
+		cc:                   cc,
+		resolver:             netResolver,
+		disableServiceConfig: opts.DisableServiceConfig,
+		rn:                   make(chan struct{}, 1),
+	}
+
+	d.wg.Add(1)
+	go d.watcher()
+	d.ResolveNow(resolver.ResolveNowOptions{})
+	return d, nil
+}
+
+// dnsResolver watches for the name resolution update for a specific target.
+type dnsResolver struct {
+	host     string
+	port     string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	cc       resolver.ClientConn
+	resolver *net.Resolver
+
+	disableServiceConfig bool
+
+	// rn channel is used by ResolveNow() to force an immediate resolution of
+	// the target.
+	rn chan struct{}
+	wg sync.WaitGroup
+}
+
+// ResolveNow invokes an immediate resolution of the target that this
+// dnsResolver watches.
+func (d *dnsResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case d.rn <- struct{}{}:
+	default:
+	}
+}
+
+// Close closes the dnsResolver.
+func (d *dnsResolver) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+func (d *dnsResolver) watcher() {
+	defer d.wg.Done()
+	backoff := minDNSResRate
+	for {
+		state, err := d.lookup()
+		if err != nil {
+			d.cc.ReportError(err)
+			backoff *= 2
+			if backoff > maxDNSResBackoff {
+				backoff = maxDNSResBackoff
+			}
+		} else {
+			d.cc.UpdateState(*state)
+			backoff = minDNSResRate
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-d.ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		case <-d.rn:
+			t.Stop()
+		}
+	}
+}
+
+func (d *dnsResolver) lookup() (*resolver.State, error) {
+	addrs, err := d.lookupHost()
+	if err != nil {
+		return nil, err
+	}
+	addrs = append(addrs, d.lookupSRV()...)
+	state := &resolver.State{Addresses: addrs}
+	if !d.disableServiceConfig {
+		state.ServiceConfig = d.lookupServiceConfig()
+	}
+	return state, nil
+}
+
+func (d *dnsResolver) lookupHost() ([]resolver.Address, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, 30*time.Second)
+	defer cancel()
+
+	ips, err := d.resolver.LookupIPAddr(ctx, d.host)
+	if err != nil {
+		return nil, fmt.Errorf("dns: lookup host %q: %v", d.host, err)
+	}
+	addrs := make([]resolver.Address, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, resolver.Address{Addr: net.JoinHostPort(ip.String(), d.port)})
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Addr < addrs[j].Addr })
+	return addrs, nil
+}
+
+// lookupSRV resolves "_grpclb._tcp.<host>" and returns one Address, tagged
+// as a GRPCLB balancer address, per IP address of each target returned. A SRV lookup failure is
+// not an error: most deployments have no grpclb balancers to discover.
+func (d *dnsResolver) lookupSRV() []resolver.Address {
+	ctx, cancel := context.WithTimeout(d.ctx, 30*time.Second)
+	defer cancel()
+
+	_, srvs, err := d.resolver.LookupSRV(ctx, "grpclb", "tcp", d.host)
+	if err != nil {
+		return nil
+	}
+	var addrs []resolver.Address
+	for _, srv := range srvs {
+		ips, err := d.resolver.LookupHost(ctx, srv.Target)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, resolver.Address{
+				Addr:       net.JoinHostPort(ip, strconv.Itoa(int(srv.Port))),
+				ServerName: strings.TrimSuffix(srv.Target, "."),
+				Type:       resolver.GRPCLB,
+			})
+		}
+	}
+	return addrs
+}
+
+// lookupServiceConfig issues a TXT lookup for "_grpc_config.<host>" and
+// returns the parsed result of the first "go"-language choice whose
+// percentage selector matches this host, or nil if none applies.
+func (d *dnsResolver) lookupServiceConfig() *serviceconfig.ParseResult {
+	ctx, cancel := context.WithTimeout(d.ctx, 30*time.Second)
+	defer cancel()
+
+	recs, err := d.resolver.LookupTXT(ctx, txtAttribute+d.host)
+	if err != nil {
+		// Service config via TXT record is best-effort; a lookup failure
+		// (e.g. no such TXT record) is not reported as a resolver error.
+		return nil
+	}
+
+	var txt string
+	for _, r := range recs {
+		if strings.HasPrefix(r, txtPrefix) {
+			txt += strings.TrimPrefix(r, txtPrefix)
+		}
+	}
+	if txt == "" {
+		return nil
+	}
+
+	var choices []grpcServiceConfigChoice
+	if err := json.Unmarshal([]byte(txt), &choices); err != nil {
+		d.cc.ReportError(fmt.Errorf("dns: error parsing DNS TXT service config record: %v", err))
+		return nil
+	}
+
+	js := d.canarySelect(choices)
+	if js == "" {
+		return nil
+	}
+	sc := d.cc.ParseServiceConfig(js)
+	return sc
+}
+
+// grpcServiceConfigChoice is one entry of the JSON array format defined by
+// naming.md for the "_grpc_config" TXT record.
+type grpcServiceConfigChoice struct {
+	ClientLanguage []string        `json:"clientLanguage,omitempty"`
+	Percentage     *int            `json:"percentage,omitempty"`
+	ClientHostname []string        `json:"clientHostname,omitempty"`
+	ServiceConfig  json.RawMessage `json:"serviceConfig,omitempty"`
+}
+
+// canarySelect returns the raw service config JSON for the first choice that
+// applies to this client, using a deterministic per-hostname percentage
+// selector so that all processes on the same host make the same choice.
+func (d *dnsResolver) canarySelect(choices []grpcServiceConfigChoice) string {
+	for _, c := range choices {
+		if !matchesLanguage(c.ClientLanguage) {
+			continue
+		}
+		if len(c.ClientHostname) > 0 && !contains(c.ClientHostname, d.host) {
+			continue
+		}
+		if c.Percentage != nil && !d.percentageMatch(*c.Percentage) {
+			continue
+		}
+		return string(c.ServiceConfig)
+	}
+	return ""
+}
+
+func matchesLanguage(langs []string) bool {
+	if len(langs) == 0 {
+		return true
+	}
+	for _, l := range langs {
+		if strings.EqualFold(l, "go") {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// percentageMatch hashes d.host into [0, 100) so that the decision is stable
+// across repeated lookups from the same client.
+func (d *dnsResolver) percentageMatch(pct int) bool {
+	if pct >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(d.host))
+	return int(h.Sum32()%100) < pct
+}
+
+// parseTarget takes the user input target string and default port, returns
+// formatted host and port info. If target doesn't specify a port, set the
+// port to be the defaultPort. If target is in IPv6 format and host-name is
+// enclosed in square brackets, brackets are stripped when setting the host.
+func parseTarget(target, defaultPort string) (host, port string, err error) {
+	if target == "" {
+		return "", "", fmt.Errorf("dns: missing address")
+	}
+	if ip := net.ParseIP(target); ip != nil {
+		// target is an IPv4 or IPv6(without brackets) address.
+		return target, defaultPort, nil
+	}
+	if host, port, err = net.SplitHostPort(target); err == nil {
+		if port == "" {
+			return "", "", fmt.Errorf("dns: missing port after port-separator colon")
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		return host, port, nil
+	}
+	if host, port, err = net.SplitHostPort(target + ":" + defaultPort); err == nil {
+		return host, port, nil
+	}
+	return "", "", fmt.Errorf("dns: invalid target address %q", target)
+}
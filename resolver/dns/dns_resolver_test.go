@@ -0,0 +1,89 @@
+/*
+ *
+ * Copyright 2023 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package dns
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		target   string
+		wantHost string
+		wantPort string
+		wantErr  bool
+	}{
+		{"foo.bar:443", "foo.bar", "443", false},
+		{"foo.bar", "foo.bar", defaultPort, false},
+		{"1.2.3.4:443", "1.2.3.4", "443", false},
+		{"1.2.3.4", "1.2.3.4", defaultPort, false},
+		{"", "", "", true},
+		{"foo.bar:", "", "", true},
+	}
+	for _, tt := range tests {
+		host, port, err := parseTarget(tt.target, defaultPort)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTarget(%q, %q) error = %v, wantErr %v", tt.target, defaultPort, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if host != tt.wantHost || port != tt.wantPort {
+			t.Errorf("parseTarget(%q, %q) = (%q, %q), want (%q, %q)", tt.target, defaultPort, host, port, tt.wantHost, tt.wantPort)
+		}
+	}
+}
+
+// TestBuildUsesResolverTargetEndpoint exercises the path that chunk0-3's
+// ParseTarget bug broke: a "dns:///host:port" target's Endpoint must carry
+// "host:port" through to Build unchanged, since Build splits it with
+// parseTarget to get the host it will query.
+func TestBuildUsesResolverTargetEndpoint(t *testing.T) {
+	target := resolver.ParseTarget("dns:///foo.bar:12345")
+	if target.Endpoint != "foo.bar:12345" {
+		t.Fatalf("resolver.ParseTarget(%q).Endpoint = %q, want %q", "dns:///foo.bar:12345", target.Endpoint, "foo.bar:12345")
+	}
+
+	d, err := (&builder{}).Build(target, &testClientConn{}, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("Build(%+v) failed: %v", target, err)
+	}
+	defer d.Close()
+
+	dr := d.(*dnsResolver)
+	if dr.host != "foo.bar" || dr.port != "12345" {
+		t.Errorf("dnsResolver = {host: %q, port: %q}, want {host: %q, port: %q}", dr.host, dr.port, "foo.bar", "12345")
+	}
+}
+
+// testClientConn is a minimal resolver.ClientConn that discards everything
+// it's given, just enough to let Build's background watcher run harmlessly.
+type testClientConn struct {
+	resolver.ClientConn
+}
+
+func (testClientConn) UpdateState(resolver.State) {}
+func (testClientConn) ReportError(error)          {}
+func (testClientConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return nil
+}
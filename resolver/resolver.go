@@ -23,6 +23,8 @@ package resolver
 import (
 	"context"
 	"net"
+	"net/url"
+	"strings"
 
 	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/credentials"
@@ -36,8 +38,6 @@ var (
 	defaultScheme = "passthrough"
 )
 
-// TODO(bar) install dns resolver in init(){}.
-
 // Register registers the resolver builder to the resolver map. b.Scheme will be
 // used as the scheme registered with this builder.
 //
@@ -208,9 +208,74 @@ type ClientConn interface {
 // 如果已解析的scheme未注册（即没有相应的resolver可用于解析endpoint），则将Scheme设置为默认方案，并将Endpoint设置为完整的目标字符串。
 // 例如 目标字符串 "unknown_scheme://authority/endpoint"将被解析为&Target{Scheme: resolver.GetDefaultScheme(), Endpoint: "unknown_scheme://authority/endpoint"}。
 type Target struct {
-	Scheme    string
+	// URL 是对原始dial target字符串解析后的结果(通过ParseTarget得到)。
+	// Scheme、Authority、Endpoint均来源于URL的对应部分，为了向后兼容而保留。
+	// 自定义resolver可以从URL中读取Query等标准URI组件携带的额外信息
+	// (例如 "consul://dc1/my-service?dc=dc1&tag=primary")。
+	//
+	// URL is the parsed dial target. Scheme, Authority and Endpoint below are
+	// all derived from URL and kept only for backward compatibility with
+	// resolver.Builder implementations that were written before URL existed.
+	URL url.URL
+
+	// Deprecated: use URL.Scheme instead.
+	Scheme string
+	// Deprecated: use URL.Host instead.
 	Authority string
-	Endpoint  string
+	// Deprecated: use URL.Path or URL.Opaque instead.
+	Endpoint string
+}
+
+// ParseTarget parses target into a Target struct.
+//
+// Scheme/Authority/Endpoint are computed by hand, the same way gRPC has
+// always parsed dial targets: ParseTarget looks for a literal "://" rather
+// than trusting net/url's scheme detection, because net/url treats any
+// "word:" prefix as a scheme -- which would misparse a plain "host:port"
+// target like "localhost:50051" as scheme "localhost" with no authority,
+// and rejects "127.0.0.1:50051" outright. Only once a target actually contains "://" do
+// we split it into scheme, authority (up to the next "/") and endpoint
+// (everything after); a target without "://" has no authority and its
+// entire contents become Endpoint, to be combined with the default scheme.
+//
+// URL is then populated from url.Parse(target) when that parse agrees with
+// the scheme computed above (which is the common case for well-formed
+// targets, and is what lets a custom resolver read extra components like
+// Query out of "consul://dc1/my-service?dc=dc1&tag=primary"), falling back
+// to a URL built from Scheme/Authority/Endpoint directly when it doesn't,
+// e.g. because net/url rejected the target outright or mis-detected its
+// scheme the same way described above.
+//
+// ParseTarget一律不返回错误；不含"://"的target会得到一个Scheme为
+// GetDefaultScheme()、Authority为空、Endpoint为完整原始字符串的Target。
+func ParseTarget(target string) Target {
+	var scheme, authority, endpoint string
+	if idx := strings.Index(target, "://"); idx > 0 {
+		scheme = target[:idx]
+		rest := target[idx+len("://"):]
+		if i := strings.Index(rest, "/"); i >= 0 {
+			authority, endpoint = rest[:i], rest[i+1:]
+		} else {
+			authority = rest
+		}
+	} else {
+		scheme = GetDefaultScheme()
+		endpoint = target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != scheme {
+		// Either url.Parse rejected target as not a valid URI at all, or it
+		// parsed a scheme that disagrees with the one computed above (the
+		// bare "host:port" case). Either way, trust the hand-parsed triple
+		// and build URL from it instead of from net/url's result.
+		u = &url.URL{Scheme: scheme, Host: authority, Path: "/" + endpoint}
+		if authority == "" {
+			u.Opaque, u.Path = endpoint, ""
+		}
+	}
+
+	return Target{URL: *u, Scheme: scheme, Authority: authority, Endpoint: endpoint}
 }
 
 // Builder将创建一个解析器，该解析器将用于监视名称解析更新。
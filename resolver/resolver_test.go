@@ -0,0 +1,65 @@
+/*
+ *
+ * Copyright 2023 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package resolver
+
+import "testing"
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		target        string
+		wantScheme    string
+		wantAuthority string
+		wantEndpoint  string
+	}{
+		{"dns:///foo.bar:443", "dns", "", "foo.bar:443"},
+		{"dns://8.8.8.8/foo.bar:443", "dns", "8.8.8.8", "foo.bar:443"},
+		{"unix:///tmp/socket", "unix", "", "tmp/socket"},
+		{"passthrough:///foo.bar", "passthrough", "", "foo.bar"},
+		// Bare "host:port" targets have no "://" and must not be mistaken
+		// for a scheme -- net/url alone would parse "localhost:50051" as
+		// scheme "localhost" with opaque "50051", and rejects
+		// "127.0.0.1:50051" with an error.
+		{"localhost:50051", defaultScheme, "", "localhost:50051"},
+		{"127.0.0.1:50051", defaultScheme, "", "127.0.0.1:50051"},
+		{"", defaultScheme, "", ""},
+	}
+	for _, tt := range tests {
+		got := ParseTarget(tt.target)
+		if got.Scheme != tt.wantScheme || got.Authority != tt.wantAuthority || got.Endpoint != tt.wantEndpoint {
+			t.Errorf("ParseTarget(%q) = {Scheme: %q, Authority: %q, Endpoint: %q}, want {Scheme: %q, Authority: %q, Endpoint: %q}",
+				tt.target, got.Scheme, got.Authority, got.Endpoint, tt.wantScheme, tt.wantAuthority, tt.wantEndpoint)
+		}
+	}
+}
+
+// TestParseTargetQuery exercises the scenario that motivated exposing URL on
+// Target in the first place: a custom resolver reading extra dial
+// parameters out of the query string of a target net/url can parse cleanly.
+func TestParseTargetQuery(t *testing.T) {
+	got := ParseTarget("consul://dc1/my-service?dc=dc1&tag=primary")
+	if got.Scheme != "consul" || got.Authority != "dc1" {
+		t.Fatalf("ParseTarget(...) = {Scheme: %q, Authority: %q}, want {Scheme: %q, Authority: %q}", got.Scheme, got.Authority, "consul", "dc1")
+	}
+	if dc := got.URL.Query().Get("dc"); dc != "dc1" {
+		t.Errorf("URL.Query().Get(%q) = %q, want %q", "dc", dc, "dc1")
+	}
+	if tag := got.URL.Query().Get("tag"); tag != "primary" {
+		t.Errorf("URL.Query().Get(%q) = %q, want %q", "tag", tag, "primary")
+	}
+}